@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"wv2/migrations"
+	"wv2/utils"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// A command run from the command line instead of starting the server
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"schema-export": {
+		usage: "Print the JSON Schema or OpenAPI document of the database",
+		run:   cmdSchemaExport,
+	},
+	"migrate": {
+		usage: "Apply (up), revert (down) or list (status) database migrations",
+		run:   cmdMigrate,
+	},
+	"snapshot-take": {
+		usage: "Store a snapshot of the live schema",
+		run:   cmdSnapshotTake,
+	},
+	"snapshot-list": {
+		usage: "List the stored schema snapshots",
+		run:   cmdSnapshotList,
+	},
+	"snapshot-diff": {
+		usage: "Compare two schema snapshots, or a snapshot and the live schema",
+		run:   cmdSnapshotDiff,
+	},
+}
+
+// Runs the command named by args[0]
+func runCommand(args []string) error {
+	cmd, ok := commands[args[0]]
+
+	if !ok {
+		var names []string
+
+		for name, c := range commands {
+			names = append(names, "  "+name+": "+c.usage)
+		}
+
+		sort.Strings(names)
+
+		fmt.Fprintln(os.Stderr, "Commands:")
+
+		for _, name := range names {
+			fmt.Fprintln(os.Stderr, name)
+		}
+
+		return errors.New("unknown command " + args[0])
+	}
+
+	var err error
+
+	pool, err = pgxpool.Connect(ctx, "")
+
+	if err != nil {
+		return err
+	}
+
+	defer pool.Close()
+
+	return cmd.run(args[1:])
+}
+
+func cmdSchemaExport(args []string) error {
+	flags := flag.NewFlagSet("schema-export", flag.ExitOnError)
+
+	format := flags.String("format", "jsonschema", "jsonschema or openapi")
+	tableName := flags.String("table", "", "Only export this table")
+	out := flags.String("out", "", "Write to this file instead of stdout")
+
+	flags.Parse(args)
+
+	schema, err := utils.GetSchema(ctx, pool, utils.SchemaFilter{TableName: *tableName})
+
+	if err != nil {
+		return err
+	}
+
+	doc, err := utils.SchemaDocument(*format, *tableName, schema)
+
+	if err != nil {
+		return err
+	}
+
+	return printJSON(doc, *out)
+}
+
+// Prints a value as indented JSON, to a file if out is set
+func printJSON(v any, out string) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	bytes = append(bytes, '\n')
+
+	if out != "" {
+		return os.WriteFile(out, bytes, 0644)
+	}
+
+	_, err = os.Stdout.Write(bytes)
+	return err
+}
+
+func cmdSnapshotTake(args []string) error {
+	flags := flag.NewFlagSet("snapshot-take", flag.ExitOnError)
+
+	label := flags.String("label", "", "A label for the snapshot")
+
+	flags.Parse(args)
+
+	snap, err := utils.TakeSnapshot(ctx, pool, *label, "cli")
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Stored snapshot", snap.ID)
+	return nil
+}
+
+func cmdSnapshotList(args []string) error {
+	snaps, err := utils.ListSnapshots(ctx, pool)
+
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snaps {
+		fmt.Printf("%d\t%s\t%s\t%s\n", snap.ID, snap.CreatedAt.Format(time.RFC3339), snap.CreatedBy, snap.Label)
+	}
+
+	return nil
+}
+
+func cmdSnapshotDiff(args []string) error {
+	flags := flag.NewFlagSet("snapshot-diff", flag.ExitOnError)
+
+	from := flags.String("from", "", "The ID of the older snapshot, or live")
+	to := flags.String("to", "live", "The ID of the newer snapshot, or live")
+	out := flags.String("out", "", "Write to this file instead of stdout")
+
+	flags.Parse(args)
+
+	if *from == "" {
+		return errors.New("-from must be set")
+	}
+
+	fromSnap, err := utils.FindSnapshot(ctx, pool, *from)
+
+	if err != nil {
+		return err
+	}
+
+	toSnap, err := utils.FindSnapshot(ctx, pool, *to)
+
+	if err != nil {
+		return err
+	}
+
+	return printJSON(utils.DiffSnapshots(fromSnap, toSnap, nil), *out)
+}
+
+func cmdMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up [-to version] | down [-steps n] | status")
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+
+	switch args[0] {
+	case "up":
+		to := flags.Int("to", 0, "Only apply migrations up to this version")
+
+		flags.Parse(args[1:])
+
+		done, err := migrations.Up(ctx, pool, *to)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Applied", len(done), "migrations")
+		return nil
+	case "down":
+		steps := flags.Int("steps", 1, "The number of migrations to revert")
+
+		flags.Parse(args[1:])
+
+		done, err := migrations.Down(ctx, pool, *steps)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Reverted", len(done), "migrations")
+		return nil
+	case "status":
+		status, err := migrations.GetStatus(ctx, pool)
+
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			state := "pending"
+
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+
+			if s.Modified {
+				state += " (modified since applied)"
+			}
+
+			fmt.Printf("%04d\t%s\t%s\n", s.Version, s.Name, state)
+		}
+
+		return nil
+	}
+
+	return errors.New("unknown migrate command " + args[0])
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"wv2/migrations"
 	"wv2/routes"
 	"wv2/types"
 	"wv2/utils"
@@ -28,6 +29,7 @@ var (
 	staffServer string
 	metro       *discordgo.Session
 	pool        *pgxpool.Pool
+	consolePool *pgxpool.Pool
 	redisPool   *redis.Client
 )
 
@@ -35,7 +37,8 @@ func Route(fn routes.RouteFunc) utils.HFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Frostpaw-ID, Frostpaw-MFA, Authorization, Frostpaw-Pass")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Frostpaw-ID, Frostpaw-MFA, Frostpaw-WebAuthn, Authorization, Frostpaw-Pass")
+		w.Header().Set("Access-Control-Expose-Headers", "Frostpaw-Cursor, Frostpaw-Session-Expires, Retry-After")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		if r.Method == "OPTIONS" {
 			w.Write([]byte(""))
@@ -44,6 +47,7 @@ func Route(fn routes.RouteFunc) utils.HFunc {
 		fn(w, r, types.RouteInfo{
 			DevMode:     devMode,
 			DB:          pool,
+			ConsoleDB:   consolePool,
 			Context:     ctx,
 			Redis:       redisPool,
 			MainServer:  mainServer,
@@ -110,6 +114,35 @@ func main() {
 
 	var servers = v.GetObject("servers")
 
+	// Table and column access policy, the built-in policy is used if this does not exist
+	if err := utils.LoadPolicy(os.Getenv("HOME") + "/FatesList/config/data/lynx_policy.json"); err != nil {
+		panic(err)
+	}
+
+	// Relations between tables that have no foreign key
+	if err := utils.LoadRelations(os.Getenv("HOME") + "/FatesList/config/data/lynx_relations.json"); err != nil {
+		panic(err)
+	}
+
+	// Reverse proxies whose X-Forwarded-For is used for client IPs, only loopback if this does not exist
+	if err := utils.LoadTrustedProxies(os.Getenv("HOME") + "/FatesList/config/data/lynx_proxies.json"); err != nil {
+		panic(err)
+	}
+
+	// Names for the values of int-coded columns
+	if err := utils.LoadEnums(os.Getenv("HOME") + "/FatesList/config/data/lynx_enums.json"); err != nil {
+		panic(err)
+	}
+
+	// Run a command instead of the server, see cli.go
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	mainServer = string(servers.Get("main").GetStringBytes())
 	staffServer = string(servers.Get("staff").GetStringBytes())
 
@@ -137,6 +170,22 @@ func main() {
 
 	fmt.Println(pool.Ping(ctx))
 
+	// Only one instance migrates at a time, the others wait for it to finish
+	if _, err := migrations.Up(ctx, pool, 0); err != nil {
+		panic(err)
+	}
+
+	utils.StartSchemaListener(ctx, pool)
+
+	// The SQL console logs in as its own role, it is disabled without a password for it
+	if consolePassword := v.GetStringBytes("lynx_console_password"); len(consolePassword) > 0 {
+		consolePool, err = utils.ConnectConsole(ctx, string(consolePassword))
+
+		if err != nil {
+			fmt.Println("Could not connect as the console role, the SQL console is disabled:", err)
+		}
+	}
+
 	if devMode {
 		api = "https://api.fateslist.xyz"
 	}
@@ -0,0 +1,325 @@
+// Versioned SQL migrations of the tables electrodragon manages
+package migrations
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The table applied migrations are recorded in
+const HistoryTable = "lynx_migrations"
+
+// The key of the advisory lock held while migrating, so only one instance migrates at a time
+const lockKey int64 = 0x6c796e786d6967
+
+const historyTableSQL = `
+CREATE TABLE IF NOT EXISTS lynx_migrations (
+	version integer primary key,
+	name text not null,
+	checksum text not null,
+	applied_at timestamptz not null default now()
+)
+`
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+// Migration files are named <version>_<name>.<up|down>.sql
+var fileRegex = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Returns the checksum of the up step, used to spot migrations changed after they were applied
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// The state of a single migration
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at"`
+
+	// Whether the migration file changed after it was applied
+	Modified bool `json:"modified"`
+}
+
+// Loads every migration, ordered by version
+func Load() ([]Migration, error) {
+	entries, err := fs.ReadDir(sqlFiles, "sql")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var byVersion = make(map[int]*Migration)
+
+	for _, entry := range entries {
+		match := fileRegex.FindStringSubmatch(entry.Name())
+
+		if match == nil {
+			return nil, errors.New("invalid migration file name " + entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+
+		m, ok := byVersion[version]
+
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		bytes, err := sqlFiles.ReadFile("sql/" + entry.Name())
+
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			m.Up = string(bytes)
+		} else {
+			m.Down = string(bytes)
+		}
+	}
+
+	var migrations []Migration
+
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d must have both an up and a down step", m.Version)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Runs fn while holding the migration lock, waiting for any other instance that is migrating
+func withLock(ctx context.Context, pool *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Release()
+
+	// Advisory locks belong to the session, so the same connection must be used to unlock
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return err
+	}
+
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	if _, err := conn.Exec(ctx, historyTableSQL); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// Returns the applied migrations, mapped to their checksum and time applied
+func applied(ctx context.Context, conn *pgxpool.Conn) (map[int]string, map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT version, checksum, applied_at FROM "+HistoryTable)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	var checksums = make(map[int]string)
+	var times = make(map[int]time.Time)
+
+	for rows.Next() {
+		var version int
+		var checksum string
+		var at time.Time
+
+		if err := rows.Scan(&version, &checksum, &at); err != nil {
+			return nil, nil, err
+		}
+
+		checksums[version] = checksum
+		times[version] = at
+	}
+
+	return checksums, times, rows.Err()
+}
+
+// Runs one step of a migration and records it in the history table, in a single transaction
+func run(ctx context.Context, conn *pgxpool.Conn, m Migration, up bool) error {
+	tx, err := conn.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	step := m.Down
+
+	if up {
+		step = m.Up
+	}
+
+	if _, err := tx.Exec(ctx, step); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+	}
+
+	if up {
+		_, err = tx.Exec(ctx, "INSERT INTO "+HistoryTable+" (version, name, checksum) VALUES ($1, $2, $3)", m.Version, m.Name, m.Checksum())
+	} else {
+		_, err = tx.Exec(ctx, "DELETE FROM "+HistoryTable+" WHERE version = $1", m.Version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Applies every pending migration up to and including target, or all of them if target is 0.
+// Returns the migrations that were applied
+func Up(ctx context.Context, pool *pgxpool.Pool, target int) ([]Migration, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+
+	err = withLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		checksums, _, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if target > 0 && m.Version > target {
+				break
+			}
+
+			if _, ok := checksums[m.Version]; ok {
+				continue
+			}
+
+			fmt.Println("Applying migration", m.Version, m.Name)
+
+			if err := run(ctx, conn, m, true); err != nil {
+				return err
+			}
+
+			done = append(done, m)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Reverts the last steps applied migrations, newest first. Returns the migrations that were reverted
+func Down(ctx context.Context, pool *pgxpool.Pool, steps int) ([]Migration, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+
+	err = withLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		checksums, _, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+
+			if _, ok := checksums[m.Version]; !ok {
+				continue
+			}
+
+			fmt.Println("Reverting migration", m.Version, m.Name)
+
+			if err := run(ctx, conn, m, false); err != nil {
+				return err
+			}
+
+			done = append(done, m)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Returns the state of every migration
+func GetStatus(ctx context.Context, pool *pgxpool.Pool) ([]Status, error) {
+	migrations, err := Load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var status []Status
+
+	err = withLock(ctx, pool, func(conn *pgxpool.Conn) error {
+		checksums, times, err := applied(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			s := Status{Version: m.Version, Name: m.Name}
+
+			if checksum, ok := checksums[m.Version]; ok {
+				at := times[m.Version]
+
+				s.Applied = true
+				s.AppliedAt = &at
+				s.Modified = checksum != m.Checksum()
+			}
+
+			status = append(status, s)
+		}
+
+		return nil
+	})
+
+	return status, err
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS lynx_audit_log;
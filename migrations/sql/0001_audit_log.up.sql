@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS lynx_audit_log (
+	id bigserial primary key,
+	actor text not null,
+	perm double precision not null,
+	route text not null,
+	method text not null,
+	table_name text,
+	filters jsonb,
+	row_ids text[],
+	before jsonb,
+	after jsonb,
+	created_at timestamptz not null default now()
+);
+CREATE INDEX IF NOT EXISTS lynx_audit_log_actor_idx ON lynx_audit_log (actor, created_at);
+CREATE INDEX IF NOT EXISTS lynx_audit_log_table_idx ON lynx_audit_log (table_name, created_at);
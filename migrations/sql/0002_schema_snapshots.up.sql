@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS lynx_schema_snapshots (
+	id bigserial primary key,
+	label text not null default '',
+	created_by text not null,
+	created_at timestamptz not null default now(),
+	columns jsonb not null,
+	constraints jsonb not null
+);
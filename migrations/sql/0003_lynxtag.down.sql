@@ -0,0 +1,22 @@
+-- Only untags the tables the up step tagged, tables that already had _lynxtag keep their row identities
+DO $$
+DECLARE
+	t record;
+BEGIN
+	IF to_regclass('lynx_lynxtag_tables') IS NULL THEN
+		RETURN;
+	END IF;
+
+	FOR t IN
+		SELECT tagged.table_name FROM lynx_lynxtag_tables tagged
+		WHERE EXISTS (
+			SELECT 1 FROM information_schema.columns columns
+			WHERE columns.table_schema = 'public' AND columns.table_name = tagged.table_name AND columns.column_name = '_lynxtag'
+		)
+	LOOP
+		EXECUTE format('ALTER TABLE %I DROP COLUMN _lynxtag', t.table_name);
+	END LOOP;
+END;
+$$;
+
+DROP TABLE IF EXISTS lynx_lynxtag_tables;
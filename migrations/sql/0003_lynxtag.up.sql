@@ -0,0 +1,29 @@
+-- Tags every table with a _lynxtag column so the admin panel can identify rows.
+-- Tables added later need a new migration to be tagged. The tables tagged here are recorded
+-- in lynx_lynxtag_tables so that the down step only untags them
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS lynx_lynxtag_tables (
+	table_name text primary key,
+	tagged_at timestamptz not null default now()
+);
+
+DO $$
+DECLARE
+	t record;
+BEGIN
+	FOR t IN
+		SELECT tables.table_name FROM information_schema.tables tables
+		WHERE tables.table_schema = 'public' AND tables.table_type = 'BASE TABLE'
+		AND tables.table_name NOT IN ('lynx_migrations', 'lynx_audit_log', 'lynx_schema_snapshots', 'lynx_lynxtag_tables')
+		AND NOT EXISTS (
+			SELECT 1 FROM information_schema.columns columns
+			WHERE columns.table_schema = 'public' AND columns.table_name = tables.table_name AND columns.column_name = '_lynxtag'
+		)
+	LOOP
+		RAISE NOTICE 'Tagging %', t.table_name;
+		EXECUTE format('ALTER TABLE %I ADD COLUMN _lynxtag uuid not null unique default uuid_generate_v4()', t.table_name);
+		INSERT INTO lynx_lynxtag_tables (table_name) VALUES (t.table_name) ON CONFLICT DO NOTHING;
+	END LOOP;
+END;
+$$;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS lynx_recovery_codes (
+	id bigserial primary key,
+	user_id text not null,
+	code_hash text not null,
+	created_at timestamptz not null default now()
+);
+CREATE INDEX IF NOT EXISTS lynx_recovery_codes_user_idx ON lynx_recovery_codes (user_id);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS lynx_webauthn_credentials (
+	id text primary key,
+	user_id text not null,
+	name text not null default '',
+	public_key bytea not null,
+	sign_count bigint not null default 0,
+	created_at timestamptz not null default now(),
+	last_used timestamptz
+);
+CREATE INDEX IF NOT EXISTS lynx_webauthn_credentials_user_idx ON lynx_webauthn_credentials (user_id);
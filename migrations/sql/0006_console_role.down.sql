@@ -0,0 +1,9 @@
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'lynx_console') THEN
+		-- Removes the grants of the role so it can be dropped
+		DROP OWNED BY lynx_console;
+		DROP ROLE lynx_console;
+	END IF;
+END;
+$$;
@@ -0,0 +1,22 @@
+-- The role SQL console queries run as. electrodragon logs in as it with a separate pool, using
+-- lynx_console_password from secrets.json (set it with ALTER ROLE lynx_console PASSWORD '...').
+-- It is not a member of any role, so it can only read the columns electrodragon grants it
+DO $$
+DECLARE
+	granted text;
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'lynx_console') THEN
+		CREATE ROLE lynx_console LOGIN NOINHERIT NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION;
+	ELSE
+		ALTER ROLE lynx_console LOGIN NOINHERIT NOSUPERUSER NOCREATEDB NOCREATEROLE NOREPLICATION;
+	END IF;
+
+	FOR granted IN
+		SELECT r.rolname FROM pg_auth_members m
+		JOIN pg_roles r ON r.oid = m.roleid
+		WHERE m.member = (SELECT oid FROM pg_roles WHERE rolname = 'lynx_console')
+	LOOP
+		EXECUTE format('REVOKE %I FROM lynx_console', granted);
+	END LOOP;
+END;
+$$;
@@ -18,9 +18,21 @@ func loadRoutes(r *mux.Router) {
 	// Admin schema fetch
 	r.HandleFunc("/ap/schema", Route(routes.AdminGetSchema))
 
+	// JSON Schema or OpenAPI documents of the tables
+	r.HandleFunc("/ap/schema/jsonschema", Route(routes.AdminGetJSONSchema))
+
+	// List or take schema snapshots
+	r.HandleFunc("/ap/schema/snapshots", Route(routes.AdminSchemaSnapshots))
+
+	// Diff two schema snapshots, or a snapshot and the live schema
+	r.HandleFunc("/ap/schema/snapshots/diff", Route(routes.AdminDiffSnapshots))
+
 	// Get allowed tables
 	r.HandleFunc("/ap/schema/allowed-tables", Route(routes.AdminGetAllowedTables))
 
+	// Get the effective access policy
+	r.HandleFunc("/ap/schema/policy", Route(routes.AdminGetPolicy))
+
 	// Staff verification endpoint
 	r.HandleFunc("/ap/newcat", Route(routes.AdminNewStaff))
 
@@ -30,7 +42,42 @@ func loadRoutes(r *mux.Router) {
 	// Staff login endpoint (for admin panel)
 	r.HandleFunc("/ap/pouncecat", Route(routes.AdminStaffLogin))
 
+	// Replace the recovery codes of a staff member
+	r.HandleFunc("/ap/recovery-codes", Route(routes.AdminRegenerateRecoveryCodes))
+
+	// Register, use and remove security keys and passkeys
+	r.HandleFunc("/ap/webauthn/register", Route(routes.AdminWebAuthnRegister))
+	r.HandleFunc("/ap/webauthn/assert", Route(routes.AdminWebAuthnAssert))
+	r.HandleFunc("/ap/webauthn/credentials", Route(routes.AdminWebAuthnCredentials))
+
 	r.HandleFunc("/ap/shadowsight", Route(routes.AdminCheckSessionValid))
 
+	// List or revoke staff sessions
+	r.HandleFunc("/ap/sessions", Route(routes.AdminSessions))
+
+	// Rotate the session ID of the current session
+	r.HandleFunc("/ap/sessions/refresh", Route(routes.AdminRefreshSession))
+
 	r.HandleFunc("/ap/tables/{table_name}", Route(routes.AdminGetTable))
+
+	// Table sizes and health
+	r.HandleFunc("/ap/stats", Route(routes.AdminGetTableStats))
+
+	// Read-only SQL console for senior staff
+	r.HandleFunc("/ap/console", Route(routes.AdminSQLConsole))
+
+	// Query the audit log
+	r.HandleFunc("/ap/audit", Route(routes.AdminGetAuditLog))
+
+	// Bulk update or delete rows matching a filter
+	r.HandleFunc("/ap/tables/{table_name}/bulk", Route(routes.AdminBulkTable))
+
+	// Stream a table as CSV or NDJSON
+	r.HandleFunc("/ap/tables/{table_name}/export", Route(routes.AdminExportTable))
+
+	// Refresh a materialized view
+	r.HandleFunc("/ap/tables/{table_name}/refresh", Route(routes.AdminRefreshView))
+
+	// Rows in other tables related to a row
+	r.HandleFunc("/ap/tables/{table_name}/related", Route(routes.AdminGetRelated))
 }
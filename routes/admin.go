@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 	"wv2/types"
 	"wv2/utils"
@@ -15,7 +14,6 @@ import (
 	"github.com/alexedwards/argon2id"
 	"github.com/gorilla/mux"
 	"github.com/happeens/xkcdpass"
-	"github.com/jackc/pgx/v5"
 	"github.com/pquerna/otp/totp"
 )
 
@@ -25,10 +23,10 @@ func AdminGetSchema(w http.ResponseWriter, r *http.Request, opts types.RouteInfo
 		return
 	}
 
-	schemaOtps := utils.SchemaFilter{}
+	schemaOtps, ok := schemaFilter(w, r, opts)
 
-	if r.URL.Query().Get("table_name") != "" {
-		schemaOtps.TableName = r.URL.Query().Get("table_name")
+	if !ok {
+		return
 	}
 
 	res, err := utils.GetSchema(opts.Context, opts.DB, schemaOtps)
@@ -39,7 +37,23 @@ func AdminGetSchema(w http.ResponseWriter, r *http.Request, opts types.RouteInfo
 		return
 	}
 
-	bytes, err := json.Marshal(res)
+	var body any = res
+
+	// Keys, constraints and indexes are only sent when asked for to keep the old response shape
+	if r.URL.Query().Get("constraints") == "true" {
+		constraints, err := utils.GetConstraints(opts.Context, opts.DB, schemaOtps)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		body = types.SchemaResponse{Columns: res, Constraints: constraints}
+	}
+
+	bytes, err := json.Marshal(body)
 
 	if err != nil {
 		fmt.Println(err)
@@ -85,6 +99,41 @@ func AdminGetAllowedTables(w http.ResponseWriter, r *http.Request, opts types.Ro
 	w.Write(bytes)
 }
 
+// Returns the access policy that applies to the user
+func AdminGetPolicy(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, err := utils.AuthorizeUser(utils.AuthRequest{
+		UserID:  r.URL.Query().Get("user_id"),
+		Token:   r.Header.Get("Authorization"),
+		DevMode: opts.DevMode,
+		Context: opts.Context,
+		DB:      opts.DB,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	bytes, err := json.Marshal(auth.Policy)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
 // Staff verification endpoint
 func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
 	if r.Method != "POST" {
@@ -92,6 +141,14 @@ func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 		return
 	}
 
+	attempt := beginAttempt(w, r, opts, "verify")
+
+	if attempt == nil {
+		return
+	}
+
+	defer attempt.end(opts)
+
 	auth, err := utils.AuthorizeUser(utils.AuthRequest{
 		UserID:  r.URL.Query().Get("user_id"),
 		Token:   r.Header.Get("Authorization"),
@@ -102,11 +159,16 @@ func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 
 	if err != nil {
 		fmt.Println(err)
+		attempt.fail(w, r, opts, nil)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	if !attempt.forUser(w, r, opts) {
+		return
+	}
+
 	if auth.Verified {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("You are already verified"))
@@ -140,6 +202,7 @@ func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 	}
 
 	if !verified {
+		attempt.fail(w, r, opts, auth)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Invalid code"))
 		return
@@ -177,6 +240,19 @@ func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 		return
 	}
 
+	recoveryCodes, err := utils.GenerateRecoveryCodes(opts.Context, opts.DB, r.URL.Query().Get("user_id"))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	attempt.succeed(r, opts)
+
+	audit(r, opts, auth, utils.AuditEntry{})
+
 	opts.Bot.GuildMemberRoleAdd(opts.MainServer, r.URL.Query().Get("user_id"), auth.Perms.ID)
 	opts.Bot.GuildMemberRoleAdd(opts.StaffServer, r.URL.Query().Get("user_id"), auth.Perms.StaffID)
 
@@ -209,6 +285,8 @@ func AdminNewStaff(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 		Pass:      newPass,
 		SharedKey: newTotp.Secret(),
 		Image:     imageUrl,
+
+		RecoveryCodes: recoveryCodes,
 	}
 
 	json.NewEncoder(w).Encode(data)
@@ -245,23 +323,38 @@ func AdminStaffLogin(w http.ResponseWriter, r *http.Request, opts types.RouteInf
 		return
 	}
 
+	attempt := beginAttempt(w, r, opts, "login")
+
+	if attempt == nil {
+		return
+	}
+
+	defer attempt.end(opts)
+
 	auth, err := utils.AuthorizeUser(utils.AuthRequest{
 		UserID:   r.URL.Query().Get("user_id"),
 		Token:    r.Header.Get("Authorization"),
 		TOTP:     r.Header.Get("Frostpaw-MFA"),
+		WebAuthn: r.Header.Get("Frostpaw-WebAuthn"),
 		Password: r.Header.Get("Frostpaw-Pass"),
 		DevMode:  opts.DevMode,
 		Context:  opts.Context,
 		DB:       opts.DB,
+		Redis:    opts.Redis,
 	})
 
 	if err != nil {
 		fmt.Println(err)
+		attempt.fail(w, r, opts, nil)
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
+	if !attempt.forUser(w, r, opts) {
+		return
+	}
+
 	if !auth.Verified {
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("You have not completed staff verification yet"))
@@ -269,14 +362,16 @@ func AdminStaffLogin(w http.ResponseWriter, r *http.Request, opts types.RouteInf
 	}
 
 	if !auth.PasswordLogin {
+		attempt.fail(w, r, opts, auth)
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("Password incorrect. Retry staff verification if you have not done it before"))
 		return
 	}
 
-	if !auth.MFA {
+	if !auth.MFA && !auth.RecoveryCode {
+		attempt.fail(w, r, opts, auth)
 		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("MFA incorrect. Retry staff verification if you have not done it before"))
+		w.Write([]byte("MFA incorrect. Send a TOTP code in Frostpaw-MFA or a security key assertion in Frostpaw-WebAuthn"))
 		return
 	}
 
@@ -286,14 +381,41 @@ func AdminStaffLogin(w http.ResponseWriter, r *http.Request, opts types.RouteInf
 		return
 	}
 
-	session := utils.RandString(512)
+	// Checked last as it uses up a recovery code, or the TOTP code so it cannot be used again for actions that need fresh MFA
+	if auth.RecoveryCode {
+		used, err := utils.UseRecoveryCode(opts.Context, opts.DB, r.URL.Query().Get("user_id"), r.Header.Get("Frostpaw-MFA"))
 
-	authSession := map[string]string{
-		"user_id": r.URL.Query().Get("user_id"),
-		"token":   r.Header.Get("Authorization"),
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		if !used {
+			attempt.fail(w, r, opts, auth)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("MFA incorrect. This recovery code is incorrect or has already been used"))
+			return
+		}
+	} else if !auth.WebAuthn {
+		fresh, err := utils.ConsumeTOTP(opts.Context, opts.Redis, r.URL.Query().Get("user_id"), r.Header.Get("Frostpaw-MFA"))
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		if !fresh {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("This TOTP code has already been used, wait for a new one"))
+			return
+		}
 	}
 
-	bytes, err := json.Marshal(authSession)
+	session, _, err := utils.CreateSession(opts.Context, opts.Redis, r.URL.Query().Get("user_id"), r.Header.Get("Authorization"), clientIP(r), r.UserAgent())
 
 	if err != nil {
 		fmt.Println(err)
@@ -302,7 +424,9 @@ func AdminStaffLogin(w http.ResponseWriter, r *http.Request, opts types.RouteInf
 		return
 	}
 
-	opts.Redis.Set(opts.Context, session, bytes, time.Hour*2)
+	attempt.succeed(r, opts)
+
+	audit(r, opts, auth, utils.AuditEntry{})
 
 	w.Write([]byte(session))
 }
@@ -331,6 +455,8 @@ func AdminCheckSessionValid(w http.ResponseWriter, r *http.Request, opts types.R
 		return
 	}
 
+	sessionExpiresHeader(w, auth)
+
 	w.Write([]byte("OK"))
 }
 
@@ -338,74 +464,45 @@ func AdminCheckSessionValid(w http.ResponseWriter, r *http.Request, opts types.R
 
 - user_id -> The user ID
 
+- schema_name -> The postgres schema of the table, defaults to public (tables can also be named schema.table)
+
 - limit -> The number of results to return
 
 - offset -> The number of results to skip
 
-- search_by -> The field to search by
+- cursor -> The Frostpaw-Cursor header of the previous page, fetches the page after it (ignores offset)
 
-- search_val -> The value to search for
+- columns -> Comma separated columns to return, defaults to every non-secret column
 
-- count -> Whether to return the total number of results or the results themselves */
-func AdminGetTable(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
-	auth, err := utils.AuthorizeUser(utils.AuthRequest{
-		UserID:    r.URL.Query().Get("user_id"),
-		Token:     r.Header.Get("Authorization"),
-		SessionID: r.Header.Get("Frostpaw-ID"),
-		DevMode:   opts.DevMode,
-		Context:   opts.Context,
-		DB:        opts.DB,
-		Redis:     opts.Redis,
-	})
+- filter -> A JSON filter expression, see utils.Filter
 
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
-	}
+- search_by -> The field to search by (deprecated, use filter)
 
-	if auth.Perms.Perm < 2 || !auth.SessionValidated {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("You do not have permission to do this"))
-		return
-	}
+- search_val -> The value to search for (deprecated, use filter)
 
-	tableName := mux.Vars(r)["table_name"]
+- order_by -> Comma separated columns to sort by, _lynxtag is always added as a tie-breaker
 
-	if len(auth.AllowedTables) > 0 {
-		// We have a limitation on allowed tables, check if the table is allowed
-		var allowedTable bool
+- order -> asc or desc, either once for all columns or once per order_by column
 
-		for _, table := range auth.AllowedTables {
-			if table == tableName {
-				allowedTable = true
-				break
-			}
-		}
+- count -> Whether to return the total number of results or the results themselves
 
-		if !allowedTable {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("You do not have permission to do this"))
-			return
-		}
-	}
+- labels -> Whether to add the names of enum values to each row as _lynxlabels
 
-	// Get schema
-	schema, err := utils.GetSchema(opts.Context, opts.DB, utils.SchemaFilter{
-		TableName: tableName,
-	})
+POST, PATCH and DELETE are handled by adminWriteRow */
+func AdminGetTable(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	auth, tableName, schema, ok := tableAccess(w, r, opts)
 
-	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(internalError))
+	if !ok {
 		return
 	}
 
-	if len(schema) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("This table does not exist"))
+	switch r.Method {
+	case "GET":
+	case "POST", "PATCH", "DELETE":
+		adminWriteRow(w, r, opts, auth, tableName, schema)
+		return
+	default:
+		w.Write([]byte(invalidMethod))
 		return
 	}
 
@@ -419,185 +516,156 @@ func AdminGetTable(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
 	if !count {
 		limit, _ = strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
 		offset, _ = strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
-		limit = utils.Min(utils.Max(limit, 50), 50)
+		if limit <= 0 {
+			limit = 50
+		}
+
+		limit = utils.Min(limit, 50)
 		offset = utils.Max(offset, 0)
 	}
 
-	fmt.Println(limit, offset)
+	filter, err := tableFilter(r)
 
-	searchBy := r.URL.Query().Get("search_by")
-	searchVal := r.URL.Query().Get("search_val")
-	limitN := "2"  // Limit number
-	offsetN := "3" // Offset number
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 
-	parseSql := func(sql string) (pgx.Rows, error) {
-		if count {
-			fmt.Println("Counting", sql)
+	var args []any
 
-			if offsetN == "2" {
-				return opts.DB.Query(opts.Context, strings.Replace(sql, "SELECT *", "SELECT COUNT(*)", 1))
-			}
+	sql := " FROM " + utils.QuoteTable(tableName)
 
-			return opts.DB.Query(opts.Context, strings.Replace(sql, "SELECT *", "SELECT COUNT(*)", 1), searchVal)
-		}
+	if filter != nil {
+		where, err := filter.ToSQL(schema, &args)
 
-		if offsetN == "2" {
-			return opts.DB.Query(opts.Context, sql+" LIMIT $"+limitN+" OFFSET $"+offsetN, limit, offset)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		return opts.DB.Query(opts.Context, sql+" LIMIT $"+limitN+" OFFSET $"+offsetN, searchVal, limit, offset)
+		sql += " WHERE " + where
 	}
 
-	// Normal case (no search val or search by)
-
-	var cols pgx.Rows
+	if count {
+		var count int64
 
-	if searchBy == "" || searchVal == "" {
-		limitN, offsetN = "1", "2"
-		cols, err = parseSql("SELECT * FROM " + tableName)
+		err = opts.DB.QueryRow(opts.Context, "SELECT COUNT(*)"+sql, args...).Scan(&count)
 
 		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(internalError))
+			writeDBError(w, err)
 			return
 		}
-	} else {
-		// Make sure the searchBy column is in the schema
-		var found bool
-
-		for _, col := range schema {
-			if col.ColumnName == searchBy && !col.Secret {
-				found = true
-				break
-			}
-		}
 
-		if !found {
+		audit(r, opts, auth, utils.AuditEntry{TableName: tableName})
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(strconv.FormatInt(count, 10)))
+		return
+	}
+
+	orderKeys, err := utils.ParseOrder(schema, r.URL.Query().Get("order_by"), r.URL.Query().Get("order"))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Keyset pagination, offset is ignored when a cursor is given
+	if cursorStr := r.URL.Query().Get("cursor"); cursorStr != "" {
+		if !utils.CursorSupported(orderKeys) {
 			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("The search_by column does not exist"))
+			w.Write([]byte("This table has not been tagged yet and does not support cursors"))
 			return
 		}
 
-		// Handle all searchVal cases
-		if searchVal == "null" {
-			limitN, offsetN = "1", "2"
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text IS NULL")
-		} else if strings.HasPrefix(searchVal, ">") {
-			searchVal = strings.TrimPrefix(searchVal, ">")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text > $1")
-		} else if strings.HasPrefix(searchVal, "<") {
-			searchVal = strings.TrimPrefix(searchVal, "<")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text < $1")
-		} else if strings.HasPrefix(searchVal, ">=") {
-			searchVal = strings.TrimPrefix(searchVal, ">=")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text >= $1")
-		} else if strings.HasPrefix(searchVal, "<=") {
-			searchVal = strings.TrimPrefix(searchVal, "<=")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text <= $1")
-		} else if strings.HasPrefix(searchVal, "!=") {
-			searchVal = strings.TrimPrefix(searchVal, "!=")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text != $1")
-		} else if strings.HasPrefix(searchVal, "=") {
-			searchVal = strings.TrimPrefix(searchVal, "=")
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text = $1")
-		} else {
-			searchVal = "%" + strings.TrimPrefix(searchVal, "@") + "%"
-			cols, err = parseSql("SELECT * FROM " + tableName + " WHERE " + searchBy + "::text ILIKE $1")
-		}
+		cursor, err := utils.DecodeCursor(cursorStr, orderKeys)
 
 		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(internalError))
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
 			return
 		}
-	}
-
-	if cols == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Something happened?"))
-		return
-	}
 
-	defer cols.Close()
+		after, err := cursor.ToSQL(schema, &args)
 
-	if count {
-		var count int64
-		cols.Next()
-		err = cols.Scan(&count)
 		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(internalError))
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(strconv.FormatInt(count, 10)))
-		return
+		if filter != nil {
+			sql += " AND " + after
+		} else {
+			sql += " WHERE " + after
+		}
+
+		offset = 0
 	}
 
-	var rows []map[string]any = []map[string]any{}
+	sql += utils.OrderSQL(orderKeys)
 
-	var fieldDescrs = cols.FieldDescriptions()
+	sql += " LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+	args = append(args, limit, offset)
 
-	var colData []string = make([]string, len(fieldDescrs))
+	selected, err := utils.ParseColumns(schema, r.URL.Query().Get("columns"))
 
-	for i, fieldDescr := range fieldDescrs {
-		colData[i] = string(fieldDescr.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
 
-	fmt.Println(colData)
+	var selectCols = "SELECT " + utils.SelectSQL(schema, selected)
 
-	for cols.Next() {
-		var row map[string]any = make(map[string]any)
+	if utils.CursorSupported(orderKeys) {
+		selectCols += utils.CursorSelect(orderKeys)
+	}
 
-		vals, err := cols.Values()
+	cols, err := opts.DB.Query(opts.Context, selectCols+sql, args...)
 
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(internalError))
-			return
-		}
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
 
-		for i, val := range vals {
-			if valD, ok := val.([16]uint8); ok {
-				val = fmt.Sprintf("%x-%x-%x-%x-%x", valD[0:4], valD[4:6], valD[6:8], valD[8:10], valD[10:16])
-			}
+	defer cols.Close()
 
-			if valD, ok := val.(map[string]any); ok {
-				valla, err := json.Marshal(valD)
+	rows, err := encodeRows(cols, schema)
 
-				if err != nil {
-					fmt.Println(err)
-					w.WriteHeader(http.StatusInternalServerError)
-					w.Write([]byte(internalError))
-					return
-				}
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
 
-				val = string(valla)
-			}
+	if labels := r.URL.Query().Get("labels"); labels == "true" || labels == "1" {
+		addLabels(rows, schema)
+	}
 
-			if valD, ok := val.(int64); ok {
-				if valD > 9007199254740914 {
-					val = strconv.FormatInt(valD, 10)
-				}
-			}
+	var rowIDs []string
 
-			row[colData[i]] = val
+	for _, row := range rows {
+		if tag, ok := row[utils.LynxTag].(string); ok {
+			rowIDs = append(rowIDs, tag)
 		}
+	}
 
-		// Remove out secret columns
-		for _, col := range schema {
-			if col.Secret {
-				delete(row, col.ColumnName)
-			}
-		}
+	audit(r, opts, auth, utils.AuditEntry{TableName: tableName, RowIDs: rowIDs})
 
-		rows = append(rows, row)
+	if utils.CursorSupported(orderKeys) {
+		cursor := utils.CursorFromRows(rows, orderKeys)
+
+		// A short page means there is nothing left to fetch
+		if int64(len(rows)) == limit {
+			w.Header().Set("Frostpaw-Cursor", cursor.Encode())
+		}
 	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(rows)
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Sets Retry-After to a duration, rounded up to whole seconds
+func retryAfter(w http.ResponseWriter, d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	return seconds
+}
+
+// An attempt at an action (scope), counted before its credentials are checked so that parallel
+// guesses cannot get past the attempt limits
+type attempt struct {
+	scope        string
+	reservations []*utils.Reservation
+	failed       bool
+}
+
+// Refuses the request with 429 if it is locked out after too many failed attempts. Returns true if a response has already been written
+func attemptRefused(w http.ResponseWriter, d time.Duration, err error) bool {
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return true
+	}
+
+	if d <= 0 {
+		return false
+	}
+
+	seconds := retryAfter(w, d)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too many failed attempts, retry in " + strconv.Itoa(seconds) + " seconds"))
+	return true
+}
+
+// Reserves an attempt at an action (scope) from the IP of the request, before anything is checked.
+// Returns nil if the IP is locked out, in which case a response has already been written. Callers
+// must defer end on the attempt
+func beginAttempt(w http.ResponseWriter, r *http.Request, opts types.RouteInfo, scope string) *attempt {
+	res, d, err := utils.ReserveIPAttempt(opts.Context, opts.Redis, scope, clientIP(r))
+
+	if attemptRefused(w, d, err) {
+		return nil
+	}
+
+	return &attempt{scope: scope, reservations: []*utils.Reservation{res}}
+}
+
+// Also counts the attempt against the user ID once the API token has checked out, and before the result
+// of the password or MFA check is used. Before that only the IP counts so that anyone cannot lock a
+// staff member out by sending their user ID. Returns false if the user ID is locked out, in which case
+// a response has already been written
+func (a *attempt) forUser(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) bool {
+	res, d, err := utils.ReserveUserAttempt(opts.Context, opts.Redis, a.scope, r.URL.Query().Get("user_id"))
+
+	if attemptRefused(w, d, err) {
+		return false
+	}
+
+	a.reservations = append(a.reservations, res)
+	return true
+}
+
+// Keeps the attempt as a failure. Must be called before the response is written so that Retry-After can be
+// set if this failure starts a lockout, which is also recorded in the audit log
+func (a *attempt) fail(w http.ResponseWriter, r *http.Request, opts types.RouteInfo, auth *utils.AuthResponse) {
+	a.failed = true
+
+	var longest time.Duration
+
+	for _, res := range a.reservations {
+		if res.Lockout > longest {
+			longest = res.Lockout
+		}
+	}
+
+	if longest <= 0 {
+		return
+	}
+
+	seconds := retryAfter(w, longest)
+
+	audit(r, opts, auth, utils.AuditEntry{Filters: map[string]string{
+		"event":       "lockout",
+		"scope":       a.scope,
+		"ip":          clientIP(r),
+		"retry_after": strconv.Itoa(seconds),
+	}})
+}
+
+// Forgets the failed attempts of the user at the action after a successful attempt
+func (a *attempt) succeed(r *http.Request, opts types.RouteInfo) {
+	if err := utils.ClearFailures(opts.Context, opts.Redis, a.scope, r.URL.Query().Get("user_id")); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Gives back the reserved attempts unless the attempt failed, so that only failures count
+func (a *attempt) end(opts types.RouteInfo) {
+	if a.failed {
+		return
+	}
+
+	for _, res := range a.reservations {
+		if err := res.Refund(opts.Context, opts.Redis); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
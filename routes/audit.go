@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Fills in the request details of an audit entry
+func auditEntry(r *http.Request, auth *utils.AuthResponse, entry utils.AuditEntry) utils.AuditEntry {
+	entry.Actor = r.URL.Query().Get("user_id")
+	entry.Route = r.URL.Path
+	entry.Method = r.Method
+
+	if auth != nil {
+		entry.Perm = auth.Perms.Perm
+	}
+
+	if entry.Filters == nil {
+		var filters = make(map[string]string)
+
+		for k := range r.URL.Query() {
+			if k != "user_id" {
+				filters[k] = r.URL.Query().Get(k)
+			}
+		}
+
+		if len(filters) > 0 {
+			entry.Filters = filters
+		}
+	}
+
+	return entry
+}
+
+// Records an admin panel action in the audit log. Failures are logged but do not fail the request
+func audit(r *http.Request, opts types.RouteInfo, auth *utils.AuthResponse, entry utils.AuditEntry) {
+	err := utils.WriteAudit(opts.Context, opts.DB, auditEntry(r, auth, entry))
+
+	if err != nil {
+		fmt.Println("Failed to write audit entry:", err)
+	}
+}
+
+// Queries the audit log, newest entries first. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - actor -> Only entries by this user ID
+//
+// - table_name -> Only entries on this table
+//
+// - from -> Only entries at or after this RFC 3339 time
+//
+// - to -> Only entries at or before this RFC 3339 time
+//
+// - before_id -> Only entries with an ID below this, for paging
+//
+// - limit -> The number of entries to return (max 100)
+func AdminGetAuditLog(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, auditMinPerm)
+
+	if !ok {
+		return
+	}
+
+	q := utils.AuditQuery{
+		Actor:     r.URL.Query().Get("actor"),
+		TableName: r.URL.Query().Get("table_name"),
+	}
+
+	for _, param := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if v := r.URL.Query().Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(param.name + " must be an RFC 3339 time"))
+				return
+			}
+
+			*param.dst = &t
+		}
+	}
+
+	q.BeforeID, _ = strconv.ParseInt(r.URL.Query().Get("before_id"), 10, 64)
+	q.Limit, _ = strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64)
+
+	if q.Limit <= 0 {
+		q.Limit = 50
+	}
+
+	q.Limit = utils.Min(q.Limit, 100)
+
+	entries, err := utils.QueryAudit(opts.Context, opts.DB, q)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: utils.AuditTable})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
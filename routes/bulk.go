@@ -0,0 +1,254 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Bulk update or delete of the rows of a table matching a filter
+//
+// The body is a types.BulkRequest. With dry_run set, the number of matched rows and a sample of them
+// is returned. Otherwise the change needs a fresh TOTP code in Frostpaw-MFA and runs in a single
+// transaction that is rolled back if more than bulkRowCap rows match
+func AdminBulkTable(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, tableName, schema, ok := tableAccess(w, r, opts)
+
+	if !ok {
+		return
+	}
+
+	if !writeAccess(w, auth, tableName) {
+		return
+	}
+
+	if !utils.IsWritable(schema) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Views are read-only"))
+		return
+	}
+
+	if utils.FindColumn(schema, utils.LynxTag) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("This table has not been tagged yet"))
+		return
+	}
+
+	defer r.Body.Close()
+
+	var req types.BulkRequest
+
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+
+	if err := dec.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid JSON body: " + err.Error()))
+		return
+	}
+
+	if req.Filter == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("A filter is required for bulk changes"))
+		return
+	}
+
+	var args []any
+
+	where, err := req.Filter.ToSQL(schema, &args)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var data *utils.RowData
+
+	if !req.Delete {
+		data, err = utils.ValidateRow(schema, req.Set, true)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	returning, err := utils.ParseColumns(schema, "")
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if req.DryRun {
+		var preview = types.BulkPreview{Cap: bulkRowCap}
+
+		err = opts.DB.QueryRow(opts.Context, "SELECT COUNT(*) FROM "+utils.QuoteTable(tableName)+" WHERE "+where, args...).Scan(&preview.Count)
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		cols, err := opts.DB.Query(opts.Context, "SELECT "+utils.SelectSQL(schema, returning)+" FROM "+utils.QuoteTable(tableName)+" WHERE "+where+" ORDER BY "+utils.LynxTag+" LIMIT "+strconv.Itoa(bulkSampleSize), args...)
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		preview.Sample, err = encodeRows(cols, schema)
+
+		cols.Close()
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		audit(r, opts, auth, utils.AuditEntry{TableName: tableName, Filters: req})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(preview)
+		return
+	}
+
+	// Confirming a bulk change needs a TOTP code that has not been used before
+	if !freshMFA(w, r, opts, auth) {
+		return
+	}
+
+	tx, err := opts.DB.Begin(opts.Context)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	defer tx.Rollback(opts.Context)
+
+	// Lock the matched rows, fetching one more than the cap to know if it is exceeded
+	cols, err := tx.Query(opts.Context, "SELECT "+utils.SelectSQL(schema, returning)+" FROM "+utils.QuoteTable(tableName)+" WHERE "+where+" ORDER BY "+utils.LynxTag+" LIMIT "+strconv.Itoa(bulkRowCap+1)+" FOR UPDATE", args...)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	beforeRows, err := encodeRows(cols, schema)
+
+	cols.Close()
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if len(beforeRows) > bulkRowCap {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("This would change more than " + strconv.Itoa(bulkRowCap) + " rows, narrow the filter"))
+		return
+	}
+
+	if len(beforeRows) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.BulkResult{})
+		return
+	}
+
+	var tags = make([]any, len(beforeRows))
+	var before = make(map[string]map[string]any)
+
+	for i, row := range beforeRows {
+		tag, _ := row[utils.LynxTag].(string)
+		tags[i] = tag
+		before[tag] = row
+	}
+
+	tagArr, err := utils.ToPGValue(utils.Schema{ColumnName: utils.LynxTag, Type: "uuid", Array: true}, tags)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	var sql string
+	var changeArgs []any
+
+	if req.Delete {
+		sql = "DELETE FROM " + utils.QuoteTable(tableName) + " WHERE " + utils.LynxTag + " = ANY($1) RETURNING " + utils.SelectSQL(schema, returning)
+		changeArgs = []any{tagArr}
+	} else {
+		var sets = make([]string, len(data.Columns))
+
+		for i, col := range data.Columns {
+			sets[i] = utils.QuoteColumn(col) + " = $" + strconv.Itoa(i+1)
+		}
+
+		sql = "UPDATE " + utils.QuoteTable(tableName) + " SET " + strings.Join(sets, ", ") + " WHERE " + utils.LynxTag + " = ANY($" + strconv.Itoa(len(data.Columns)+1) + ") RETURNING " + utils.SelectSQL(schema, returning)
+		changeArgs = append(data.Values, tagArr)
+	}
+
+	cols, err = tx.Query(opts.Context, sql, changeArgs...)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	afterRows, err := encodeRows(cols, schema)
+
+	cols.Close()
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	// Record the changed columns of every row, keyed by lynxtag
+	entry := utils.AuditEntry{TableName: tableName, Filters: req}
+
+	var beforeDiff = make(map[string]any)
+	var afterDiff = make(map[string]any)
+
+	for _, row := range afterRows {
+		tag, _ := row[utils.LynxTag].(string)
+		entry.RowIDs = append(entry.RowIDs, tag)
+
+		var after map[string]any
+
+		if !req.Delete {
+			after = row
+		}
+
+		beforeDiff[tag], afterDiff[tag] = utils.DiffRows(before[tag], after)
+	}
+
+	entry.Before, entry.After = beforeDiff, afterDiff
+
+	if err := utils.WriteAudit(opts.Context, tx, auditEntry(r, auth, entry)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if err := tx.Commit(opts.Context); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.BulkResult{Affected: int64(len(afterRows))})
+}
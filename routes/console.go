@@ -0,0 +1,162 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Runs a read-only SQL query for senior staff. The body is a types.ConsoleRequest and a fresh TOTP
+// code is needed in Frostpaw-MFA
+//
+// The query must be a single statement and runs on a connection logged in as utils.ConsoleRole, in a READ ONLY
+// transaction that is always rolled back, with a statement_timeout of consoleTimeout. At most consoleRowCap rows
+// are returned. The role can only read columns that are not secret, hidden or masked for consoleMinPerm, so
+// postgres refuses queries touching anything else, including whole-row and computed values. The connection is
+// closed afterwards so nothing the query leaves behind (such as advisory locks) reaches other requests.
+// Every query is recorded in the audit log before it runs
+func AdminSQLConsole(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, consoleMinPerm)
+
+	if !ok {
+		return
+	}
+
+	if opts.ConsoleDB == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("The SQL console is not set up"))
+		return
+	}
+
+	defer r.Body.Close()
+
+	var req types.ConsoleRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid JSON body: " + err.Error()))
+		return
+	}
+
+	if strings.TrimSpace(req.Query) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("A query is required"))
+		return
+	}
+
+	if !freshMFA(w, r, opts, auth) {
+		return
+	}
+
+	// Nothing runs unless it has been recorded
+	err := utils.WriteAudit(opts.Context, opts.DB, auditEntry(r, auth, utils.AuditEntry{Filters: req}))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	err = utils.EnsureConsoleGrants(opts.Context, opts.DB, utils.CurrentPolicy().ForPerm(consoleMinPerm))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	poolConn, err := opts.ConsoleDB.Acquire(opts.Context)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	// Session state such as advisory locks survives a rollback, so the connection never goes back to the pool
+	conn := poolConn.Hijack()
+
+	defer conn.Close(context.Background())
+
+	tx, err := conn.BeginTx(opts.Context, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	defer tx.Rollback(opts.Context)
+
+	if _, err := tx.Exec(opts.Context, "SET LOCAL statement_timeout = "+strconv.Itoa(consoleTimeout)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	// The extended protocol refuses more than one statement
+	rows, err := tx.Query(opts.Context, req.Query, pgx.QueryExecModeDescribeExec)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	defer rows.Close()
+
+	var res = types.ConsoleResult{
+		Columns: []string{},
+		Rows:    [][]any{},
+	}
+
+	for _, f := range rows.FieldDescriptions() {
+		res.Columns = append(res.Columns, string(f.Name))
+	}
+
+	for rows.Next() {
+		if len(res.Rows) == consoleRowCap {
+			res.Truncated = true
+			break
+		}
+
+		vals, err := rows.Values()
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		var row = make([]any, len(vals))
+
+		for i, val := range vals {
+			row[i], err = utils.EncodeValue(nil, val)
+
+			if err != nil {
+				fmt.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(internalError))
+				return
+			}
+		}
+
+		res.Rows = append(res.Rows, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
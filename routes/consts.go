@@ -19,3 +19,30 @@ const (
 
 // Defines a function for a route
 type RouteFunc func(w http.ResponseWriter, r *http.Request, opts types.RouteInfo)
+
+// Minimum perm levels for admin panel actions beyond browsing tables
+const (
+	exportMinPerm   = 3
+	snapshotMinPerm = 4
+	refreshMinPerm  = 4
+	auditMinPerm    = 5
+	consoleMinPerm  = 5
+
+	// Needed to list or revoke the sessions of other staff
+	sessionAdminMinPerm = 5
+)
+
+// The most rows a single bulk update or delete may change
+const bulkRowCap = 500
+
+// How many rows a bulk dry run returns
+const bulkSampleSize = 10
+
+// The most rows returned per relation when navigating between tables
+const relatedRowCap = 25
+
+// The most rows the SQL console returns
+const consoleRowCap = 1000
+
+// The statement_timeout of SQL console queries, in milliseconds
+const consoleTimeout = 10000
@@ -0,0 +1,209 @@
+package routes
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// How many rows to write before flushing the response
+const exportFlushEvery = 500
+
+// Formats a value for a CSV cell. Text that spreadsheets would run as a formula is prefixed with '
+func csvValue(val any) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+			return "'" + v
+		}
+
+		return v
+	}
+
+	bytes, err := json.Marshal(val)
+
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+
+	return string(bytes)
+}
+
+// Streams a table as CSV or NDJSON without buffering it
+//
+// Accepts the same columns, filter, search_by, search_val, order_by and order parameters as AdminGetTable, plus
+//
+// - format -> csv (default) or ndjson
+func AdminExportTable(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, tableName, schema, ok := tableAccess(w, r, opts)
+
+	if !ok {
+		return
+	}
+
+	if auth.Perms.Perm < exportMinPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+
+	if format == "" {
+		format = "csv"
+	}
+
+	if format != "csv" && format != "ndjson" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("format must be csv or ndjson"))
+		return
+	}
+
+	filter, err := tableFilter(r)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	selected, err := utils.ParseColumns(schema, r.URL.Query().Get("columns"))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var args []any
+
+	sql := "SELECT " + utils.SelectSQL(schema, selected) + " FROM " + utils.QuoteTable(tableName)
+
+	if filter != nil {
+		where, err := filter.ToSQL(schema, &args)
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		sql += " WHERE " + where
+	}
+
+	orderKeys, err := utils.ParseOrder(schema, r.URL.Query().Get("order_by"), r.URL.Query().Get("order"))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	sql += utils.OrderSQL(orderKeys)
+
+	// The request context so the query stops if the client goes away mid-export
+	cols, err := opts.DB.Query(r.Context(), sql, args...)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	defer cols.Close()
+
+	colData := rowColumns(cols)
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: tableName})
+
+	// The header only has the columns left after secrets are removed
+	var header []string
+
+	for _, name := range colData {
+		if col := utils.FindColumn(schema, name); col != nil && col.Secret {
+			continue
+		}
+
+		header = append(header, name)
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+tableName+"."+format+"\"")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	csvWriter := csv.NewWriter(w)
+	jsonEncoder := json.NewEncoder(w)
+
+	if format == "csv" {
+		if err := csvWriter.Write(header); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// The status has already been sent, so a failure part way through aborts the response. The client then
+	// sees the download fail instead of a file that looks complete
+	abort := func(err error) {
+		fmt.Println(err)
+		csvWriter.Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	var n int
+
+	for cols.Next() {
+		row, err := encodeRow(cols, colData, schema)
+
+		if err != nil {
+			abort(err)
+		}
+
+		if format == "csv" {
+			var record = make([]string, len(header))
+
+			for i, name := range header {
+				record[i] = csvValue(row[name])
+			}
+
+			err = csvWriter.Write(record)
+		} else {
+			err = jsonEncoder.Encode(row)
+		}
+
+		if err != nil {
+			abort(err)
+		}
+
+		n++
+
+		if n%exportFlushEvery == 0 {
+			csvWriter.Flush()
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+
+	if err := cols.Err(); err != nil {
+		abort(err)
+	}
+
+	csvWriter.Flush()
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Gets the schema filter of a schema request. The user must be logged in and only sees what their
+// policy allows. Returns false if a response has already been written
+func schemaFilter(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) (utils.SchemaFilter, bool) {
+	schemaOtps := utils.SchemaFilter{
+		TableName:  r.URL.Query().Get("table_name"),
+		SchemaName: r.URL.Query().Get("schema_name"),
+	}
+
+	auth, err := utils.AuthorizeUser(utils.AuthRequest{
+		UserID:  r.URL.Query().Get("user_id"),
+		Token:   r.Header.Get("Authorization"),
+		DevMode: opts.DevMode,
+		Context: opts.Context,
+		DB:      opts.DB,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return schemaOtps, false
+	}
+
+	schemaOtps.Policy = auth.Policy
+
+	return schemaOtps, true
+}
+
+// Generates JSON Schema or OpenAPI documents describing the rows of each table. Accepts the following parameters
+//
+// - format -> jsonschema (the default) or openapi
+//
+// - table_name -> Only this table, a jsonschema request then returns a single document
+//
+// - user_id -> The user ID, only what the users policy allows is described
+//
+// Secret columns are never included
+func AdminGetJSONSchema(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	schemaOtps, ok := schemaFilter(w, r, opts)
+
+	if !ok {
+		return
+	}
+
+	schema, err := utils.GetSchema(opts.Context, opts.DB, schemaOtps)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	doc, err := utils.SchemaDocument(r.URL.Query().Get("format"), schemaOtps.TableName, schema)
+
+	if errors.Is(err, utils.ErrNoSuchTable) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("This table does not exist"))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
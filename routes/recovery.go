@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Replaces the recovery codes of a staff member, the old ones stop working. Needs the password in
+// Frostpaw-Pass and a TOTP code (or an unused recovery code) in Frostpaw-MFA. Accepts the following parameters
+//
+// - user_id -> The user ID
+func AdminRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	// Guesses the password and MFA like login does, so shares its attempt limits
+	attempt := beginAttempt(w, r, opts, "login")
+
+	if attempt == nil {
+		return
+	}
+
+	defer attempt.end(opts)
+
+	auth, err := utils.AuthorizeUser(utils.AuthRequest{
+		UserID:   r.URL.Query().Get("user_id"),
+		Token:    r.Header.Get("Authorization"),
+		TOTP:     r.Header.Get("Frostpaw-MFA"),
+		WebAuthn: r.Header.Get("Frostpaw-WebAuthn"),
+		Password: r.Header.Get("Frostpaw-Pass"),
+		DevMode:  opts.DevMode,
+		Context:  opts.Context,
+		DB:       opts.DB,
+		Redis:    opts.Redis,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		attempt.fail(w, r, opts, nil)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !attempt.forUser(w, r, opts) {
+		return
+	}
+
+	if !auth.Verified {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You have not completed staff verification yet"))
+		return
+	}
+
+	if !auth.PasswordLogin || (!auth.MFA && !auth.RecoveryCode) {
+		attempt.fail(w, r, opts, auth)
+	}
+
+	if !auth.PasswordLogin {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Password incorrect"))
+		return
+	}
+
+	if auth.Perms.Perm < 2 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return
+	}
+
+	if !freshMFA(w, r, opts, auth) {
+		return
+	}
+
+	codes, err := utils.GenerateRecoveryCodes(opts.Context, opts.DB, r.URL.Query().Get("user_id"))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: utils.RecoveryCodeTable})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(codes)
+}
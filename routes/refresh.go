@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Refreshes a materialized view. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - concurrently -> Whether to refresh without locking out reads, the view needs a unique index for this
+func AdminRefreshView(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, tableName, schema, ok := tableAccess(w, r, opts)
+
+	if !ok {
+		return
+	}
+
+	if auth.Perms.Perm < refreshMinPerm {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return
+	}
+
+	if !writeAccess(w, auth, tableName) {
+		return
+	}
+
+	if schema[0].Kind != "materialized_view" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Only materialized views can be refreshed"))
+		return
+	}
+
+	sql := "REFRESH MATERIALIZED VIEW "
+
+	if concurrently := r.URL.Query().Get("concurrently"); concurrently == "true" || concurrently == "1" {
+		sql += "CONCURRENTLY "
+	}
+
+	if _, err := opts.DB.Exec(opts.Context, sql+utils.QuoteTable(tableName)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: tableName})
+
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,219 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Whether every column of a relation can be shown to the user, relations through secret or
+// masked columns would reveal their contents
+func relationVisible(schema []utils.Schema, columns []string) bool {
+	for _, name := range columns {
+		col := utils.FindColumn(schema, name)
+
+		if col == nil || col.Secret || col.Masked {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Gets the rows related to a row of a table, both the rows it references and the rows referencing it.
+// Uses foreign keys and the implicit relations in lynx_relations.json. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - lynxtag -> The _lynxtag of the row
+//
+// At most relatedRowCap rows are returned per relation, relations to tables the user cannot read are left out
+func AdminGetRelated(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, tableName, schema, ok := tableAccess(w, r, opts)
+
+	if !ok {
+		return
+	}
+
+	if utils.FindColumn(schema, utils.LynxTag) == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("This table has not been tagged yet"))
+		return
+	}
+
+	lynxtag := r.URL.Query().Get("lynxtag")
+
+	if !utils.IsUUID(lynxtag) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("lynxtag must be a valid uuid"))
+		return
+	}
+
+	references, referencedBy, err := utils.GetRelations(opts.Context, opts.DB, tableName)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	// The columns of the row each relation needs, as text so they can be sent back as parameters
+	type link struct {
+		direction   string
+		relation    utils.Relation
+		table       string
+		fromColumns []string
+		toColumns   []string
+	}
+
+	var links []link
+
+	for _, rel := range references {
+		links = append(links, link{"references", rel, rel.TargetTable, rel.Columns, rel.TargetColumns})
+	}
+
+	for _, rel := range referencedBy {
+		links = append(links, link{"referenced_by", rel, rel.Table, rel.TargetColumns, rel.Columns})
+	}
+
+	// Relations through columns the user cannot see are left out before anything is read, so those
+	// columns are never selected
+	var visible []link
+
+	for _, l := range links {
+		if auth.Policy.CanRead(l.table) && relationVisible(schema, l.fromColumns) {
+			visible = append(visible, l)
+		}
+	}
+
+	links = visible
+
+	var needed []string
+	var seen = make(map[string]bool)
+
+	for _, l := range links {
+		for _, name := range l.fromColumns {
+			if !seen[name] {
+				seen[name] = true
+				needed = append(needed, name)
+			}
+		}
+	}
+
+	var values = make(map[string]*string)
+
+	if len(needed) > 0 {
+		var selects = make([]string, len(needed))
+		var dest = make([]any, len(needed))
+		var vals = make([]*string, len(needed))
+
+		for i, name := range needed {
+			selects[i] = utils.QuoteColumn(name) + "::text"
+			dest[i] = &vals[i]
+		}
+
+		err = opts.DB.QueryRow(opts.Context, "SELECT "+strings.Join(selects, ", ")+" FROM "+utils.QuoteTable(tableName)+" WHERE "+utils.LynxTag+" = $1", lynxtag).Scan(dest...)
+
+		if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("This row does not exist"))
+			return
+		} else if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		for i, name := range needed {
+			values[name] = vals[i]
+		}
+	}
+
+	var res = []types.RelatedRows{}
+
+	for _, l := range links {
+		target, err := utils.GetSchema(opts.Context, opts.DB, utils.SchemaFilter{
+			TableName: l.table,
+			Policy:    auth.Policy,
+		})
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		if len(target) == 0 || !relationVisible(target, l.toColumns) {
+			continue
+		}
+
+		var conds = make([]string, len(l.toColumns))
+		var args []any
+		var isNull bool
+
+		for i, name := range l.toColumns {
+			val := values[l.fromColumns[i]]
+
+			// A null column does not point anywhere
+			if val == nil {
+				isNull = true
+				break
+			}
+
+			args = append(args, *val)
+			conds[i] = utils.QuoteColumn(name) + " = $" + strconv.Itoa(len(args))
+		}
+
+		var rows = []map[string]any{}
+
+		// Tables with only secret columns have nothing to show
+		cols, colsErr := utils.ParseColumns(target, "")
+
+		if !isNull && colsErr == nil {
+
+			sql := "SELECT " + utils.SelectSQL(target, cols) + " FROM " + utils.QuoteTable(l.table) + " WHERE " + strings.Join(conds, " AND ")
+
+			if utils.FindColumn(target, utils.LynxTag) != nil {
+				sql += " ORDER BY " + utils.LynxTag
+			}
+
+			sqlRows, err := opts.DB.Query(opts.Context, sql+" LIMIT "+strconv.Itoa(relatedRowCap), args...)
+
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+
+			rows, err = encodeRows(sqlRows, target)
+
+			sqlRows.Close()
+
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+		}
+
+		res = append(res, types.RelatedRows{
+			Direction: l.direction,
+			Relation:  l.relation,
+			Rows:      rows,
+		})
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: tableName, RowIDs: []string{lynxtag}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Returns the IP address of the client. When the connection comes from a trusted reverse proxy (see
+// utils.LoadTrustedProxies), the last hop of X-Forwarded-For is used as the proxy appends it there and
+// anything before it was sent by the client. The header is ignored otherwise as anyone could set it
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !utils.IsTrustedProxy(ip) {
+		return ip
+	}
+
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		last := fwd[len(fwd)-1]
+
+		if hop := strings.TrimSpace(last[strings.LastIndex(last, ",")+1:]); hop != "" {
+			return hop
+		}
+	}
+
+	return ip
+}
+
+// Tells the panel how many seconds are left before the session expires, so it can warn the user or refresh it
+func sessionExpiresHeader(w http.ResponseWriter, auth *utils.AuthResponse) {
+	if auth.SessionValidated {
+		w.Header().Set("Frostpaw-Session-Expires", strconv.Itoa(int(auth.SessionExpiresIn.Seconds())))
+	}
+}
+
+// Lists (GET) or revokes (DELETE) staff sessions. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - member_id -> Act on the sessions of another staff member instead, needs perm 5
+//
+// - id -> The session to revoke (the id field of a listed session)
+//
+// - all -> Set to true instead of id to revoke every session, including the current one
+func AdminSessions(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+
+	if memberID := r.URL.Query().Get("member_id"); memberID != "" && memberID != userID {
+		if auth.Perms.Perm < sessionAdminMinPerm {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("You do not have permission to do this"))
+			return
+		}
+
+		userID = memberID
+	}
+
+	if r.Method == "GET" {
+		sessions, err := utils.ListSessions(opts.Context, opts.Redis, userID)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		var res = make([]types.SessionInfo, len(sessions))
+
+		for i, s := range sessions {
+			res[i] = types.SessionInfo{Session: s, Current: s.ID == auth.Session.ID}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	var revoked int
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		ok, err := utils.RevokeSession(opts.Context, opts.Redis, userID, id)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("This session does not exist"))
+			return
+		}
+
+		revoked = 1
+	} else if all := r.URL.Query().Get("all"); all == "true" || all == "1" {
+		var err error
+
+		revoked, err = utils.RevokeAllSessions(opts.Context, opts.Redis, userID)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Either id or all must be set"))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{Filters: map[string]string{
+		"member_id": userID,
+		"id":        r.URL.Query().Get("id"),
+		"revoked":   strconv.Itoa(revoked),
+	}})
+
+	w.Write([]byte(strconv.Itoa(revoked)))
+}
+
+// Gives the current session a new session ID, the old one stops working. Sessions still expire at the
+// latest 12 hours after login. Accepts the following parameters
+//
+// - user_id -> The user ID
+func AdminRefreshSession(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return
+	}
+
+	sessionID, err := utils.RotateSession(opts.Context, opts.Redis, auth.Session)
+
+	if err == utils.ErrSessionExpired {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This session has expired, log in again"))
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	w.Write([]byte(sessionID))
+}
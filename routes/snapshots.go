@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Lists the stored schema snapshots (GET) or stores a snapshot of the live schema (POST). Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - label -> A label for the new snapshot, such as the deploy it was taken before
+func AdminSchemaSnapshots(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, snapshotMinPerm)
+
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" {
+		snaps, err := utils.ListSnapshots(opts.Context, opts.DB)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(snaps)
+		return
+	}
+
+	snap, err := utils.TakeSnapshot(opts.Context, opts.DB, r.URL.Query().Get("label"), r.URL.Query().Get("user_id"))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: utils.SnapshotTable})
+
+	// The contents can be large and are only needed for diffs
+	snap.Columns, snap.Constraints = nil, nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// Compares two schema snapshots. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - from -> The ID of the older snapshot, or live
+//
+// - to -> The ID of the newer snapshot, or live (the default)
+//
+// Only tables the user can read are compared
+func AdminDiffSnapshots(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, snapshotMinPerm)
+
+	if !ok {
+		return
+	}
+
+	var snaps [2]*utils.SchemaSnapshot
+
+	for i, ref := range []string{r.URL.Query().Get("from"), r.URL.Query().Get("to")} {
+		if ref == "" {
+			if i == 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("from must be set"))
+				return
+			}
+
+			ref = "live"
+		}
+
+		snap, err := utils.FindSnapshot(opts.Context, opts.DB, ref)
+
+		if errors.Is(err, utils.ErrInvalidSnapshot) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		} else if err == pgx.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Snapshot " + ref + " does not exist"))
+			return
+		} else if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		snaps[i] = snap
+	}
+
+	diff := utils.DiffSnapshots(snaps[0], snaps[1], auth.Policy.CanRead)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
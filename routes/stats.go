@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Gets the size, dead tuples, vacuum times and index usage of each table the user can read. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - table_name -> Only this table
+func AdminGetTableStats(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return
+	}
+
+	stats, err := utils.GetTableStats(opts.Context, opts.DB, utils.SchemaFilter{
+		TableName: r.URL.Query().Get("table_name"),
+		Policy:    auth.Policy,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
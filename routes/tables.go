@@ -0,0 +1,500 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"wv2/types"
+	"wv2/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Returns the names of the columns of a query
+func rowColumns(cols pgx.Rows) []string {
+	var fieldDescrs = cols.FieldDescriptions()
+
+	var colData []string = make([]string, len(fieldDescrs))
+
+	for i, fieldDescr := range fieldDescrs {
+		colData[i] = string(fieldDescr.Name)
+	}
+
+	return colData
+}
+
+// Converts the current row of a query into a JSON-friendly map, removing secret columns
+func encodeRow(cols pgx.Rows, colData []string, schema []utils.Schema) (map[string]any, error) {
+	var row map[string]any = make(map[string]any)
+
+	vals, err := cols.Values()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, val := range vals {
+		val, err = utils.EncodeValue(utils.FindColumn(schema, colData[i]), val)
+
+		if err != nil {
+			return nil, err
+		}
+
+		row[colData[i]] = val
+	}
+
+	// Remove out secret columns
+	for _, col := range schema {
+		if col.Secret {
+			delete(row, col.ColumnName)
+		}
+	}
+
+	return row, nil
+}
+
+// Converts the rows of a query into JSON-friendly maps, removing secret columns
+func encodeRows(cols pgx.Rows, schema []utils.Schema) ([]map[string]any, error) {
+	var rows []map[string]any = []map[string]any{}
+
+	colData := rowColumns(cols)
+
+	for cols.Next() {
+		row, err := encodeRow(cols, colData, schema)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, cols.Err()
+}
+
+// Adds the names of the enum values of each row under _lynxlabels, keyed by column
+func addLabels(rows []map[string]any, schema []utils.Schema) {
+	for _, row := range rows {
+		var labels = make(map[string]any)
+
+		for i := range schema {
+			col := &schema[i]
+
+			if len(col.Values) == 0 || col.Secret || col.Masked {
+				continue
+			}
+
+			if val, ok := row[col.ColumnName]; ok && val != nil {
+				labels[col.ColumnName] = utils.EnumLabel(col, val)
+			}
+		}
+
+		row["_lynxlabels"] = labels
+	}
+}
+
+// Checks that the user has a validated session and at least minPerm. Returns false if a response
+// has already been written
+func staffAccess(w http.ResponseWriter, r *http.Request, opts types.RouteInfo, minPerm float64) (*utils.AuthResponse, bool) {
+	auth, err := utils.AuthorizeUser(utils.AuthRequest{
+		UserID:    r.URL.Query().Get("user_id"),
+		Token:     r.Header.Get("Authorization"),
+		SessionID: r.Header.Get("Frostpaw-ID"),
+		TOTP:      r.Header.Get("Frostpaw-MFA"),
+		WebAuthn:  r.Header.Get("Frostpaw-WebAuthn"),
+		DevMode:   opts.DevMode,
+		Context:   opts.Context,
+		DB:        opts.DB,
+		Redis:     opts.Redis,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	}
+
+	if auth.Perms.Perm < minPerm || !auth.SessionValidated {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return nil, false
+	}
+
+	sessionExpiresHeader(w, auth)
+
+	return auth, true
+}
+
+// Checks that the policy lets the user write to a table and that it is not one of lynx's own tables.
+// Returns false if a response has already been written
+func writeAccess(w http.ResponseWriter, auth *utils.AuthResponse, tableName string) bool {
+	if !auth.Policy.CanWrite(tableName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return false
+	}
+
+	if utils.IsInternalTable(tableName) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This table is used by lynx itself and cannot be modified"))
+		return false
+	}
+
+	return true
+}
+
+// Checks that the request has a valid TOTP code in Frostpaw-MFA that has not been used before, for
+// actions that must be confirmed. A recovery code is used up here, so this must be the last check before
+// the action. Returns false if a response has already been written
+func freshMFA(w http.ResponseWriter, r *http.Request, opts types.RouteInfo, auth *utils.AuthResponse) bool {
+	if !auth.MFA && !auth.RecoveryCode {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("A valid TOTP code in Frostpaw-MFA or security key in Frostpaw-WebAuthn is required to do this"))
+		return false
+	}
+
+	if auth.RecoveryCode {
+		return useRecoveryCode(w, r, opts)
+	}
+
+	// WebAuthn challenges can only be used once anyways
+	if auth.WebAuthn {
+		return true
+	}
+
+	fresh, err := utils.ConsumeTOTP(opts.Context, opts.Redis, r.URL.Query().Get("user_id"), r.Header.Get("Frostpaw-MFA"))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return false
+	}
+
+	if !fresh {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This TOTP code has already been used, wait for a new one"))
+		return false
+	}
+
+	return true
+}
+
+// Uses up the recovery code in Frostpaw-MFA. Returns false if a response has already been written
+func useRecoveryCode(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) bool {
+	used, err := utils.UseRecoveryCode(opts.Context, opts.DB, r.URL.Query().Get("user_id"), r.Header.Get("Frostpaw-MFA"))
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return false
+	}
+
+	if !used {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("This recovery code is incorrect or has already been used"))
+		return false
+	}
+
+	return true
+}
+
+// Runs the checks shared by all /ap/tables/{table_name} routes: a validated session and
+// access to the table. Returns false if a response has already been written
+func tableAccess(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) (*utils.AuthResponse, string, []utils.Schema, bool) {
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return nil, "", nil, false
+	}
+
+	tableName := mux.Vars(r)["table_name"]
+
+	// Tables outside the public schema can be named schema.table or given a schema_name
+	if schemaName := r.URL.Query().Get("schema_name"); schemaName != "" && schemaName != "public" {
+		tableName = utils.QualifiedName(schemaName, tableName)
+	}
+
+	if !auth.Policy.CanRead(tableName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return nil, "", nil, false
+	}
+
+	// Get schema
+	schema, err := utils.GetSchema(opts.Context, opts.DB, utils.SchemaFilter{
+		TableName: tableName,
+		Policy:    auth.Policy,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return nil, "", nil, false
+	}
+
+	if len(schema) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("This table does not exist"))
+		return nil, "", nil, false
+	}
+
+	return auth, tableName, schema, true
+}
+
+// Gets the filter of a table request, search_by and search_val are kept for older panels.
+// Returns nil if no filter was given
+func tableFilter(r *http.Request) (*utils.Filter, error) {
+	if filterStr := r.URL.Query().Get("filter"); filterStr != "" {
+		return utils.ParseFilter(filterStr)
+	}
+
+	searchBy, searchVal := r.URL.Query().Get("search_by"), r.URL.Query().Get("search_val")
+
+	if searchBy != "" && searchVal != "" {
+		return utils.LegacyFilter(searchBy, searchVal), nil
+	}
+
+	return nil, nil
+}
+
+// The messages sent back for database errors the user can do something about, by SQLSTATE. The
+// postgres message is not sent as it can name constraints, hidden columns and values of other rows
+var dbErrorMessages = map[string]string{
+	"23502": "A required column is missing a value",
+	"23503": "This refers to a row that does not exist, or other rows still refer to it",
+	"23505": "A row with this value already exists",
+	"23514": "A value is not allowed by a check on this table",
+	"23P01": "This conflicts with another row",
+	"22001": "A value is too long",
+	"22003": "A number is out of range",
+	"22007": "A date or time is not valid",
+	"22008": "A date or time is out of range",
+	"22P02": "A value is not valid for the type of its column",
+	"22P05": "A value contains characters that are not allowed",
+	"25006": "This cannot be done in a read-only query",
+	"42501": "The database does not allow this",
+	"42601": "The query has a syntax error",
+	"42703": "A column does not exist",
+	"42P01": "A table does not exist",
+	"42883": "A function or operator does not exist",
+	"57014": "The query took too long and was cancelled",
+}
+
+// Writes a database error. Errors the user can fix get a fixed message, the details are only logged
+func writeDBError(w http.ResponseWriter, err error) {
+	fmt.Println(err)
+
+	var pgErr *pgconn.PgError
+
+	if errors.As(err, &pgErr) {
+		fmt.Println("Detail:", pgErr.Detail, "Constraint:", pgErr.ConstraintName, "Column:", pgErr.ColumnName)
+
+		if msg, ok := dbErrorMessages[pgErr.Code]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(msg))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(internalError))
+}
+
+// Handles POST (create), PATCH (update) and DELETE on /ap/tables/{table_name}
+//
+// Rows are identified by the lynxtag query parameter (the _lynxtag column of the row).
+// POST and PATCH take a JSON object of column names to values. Every change is recorded
+// in the audit log in the same transaction as the change itself
+func adminWriteRow(w http.ResponseWriter, r *http.Request, opts types.RouteInfo, auth *utils.AuthResponse, tableName string, schema []utils.Schema) {
+	if !writeAccess(w, auth, tableName) {
+		return
+	}
+
+	if !utils.IsWritable(schema) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Views are read-only"))
+		return
+	}
+
+	lynxtag := r.URL.Query().Get("lynxtag")
+
+	if r.Method != "POST" {
+		if utils.FindColumn(schema, utils.LynxTag) == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("This table has not been tagged yet"))
+			return
+		}
+
+		if !utils.IsUUID(lynxtag) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("lynxtag must be a valid uuid"))
+			return
+		}
+	}
+
+	var data *utils.RowData
+
+	if r.Method != "DELETE" {
+		defer r.Body.Close()
+
+		var payload map[string]any
+
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+
+		if err := dec.Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid JSON body: " + err.Error()))
+			return
+		}
+
+		var err error
+		data, err = utils.ValidateRow(schema, payload, r.Method == "PATCH")
+
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	// Only non-secret columns are returned
+	returning, err := utils.ParseColumns(schema, "")
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	tx, err := opts.DB.Begin(opts.Context)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	defer tx.Rollback(opts.Context)
+
+	// Lock and fetch the row as it was before the change for the audit log
+	var before map[string]any
+
+	if r.Method != "POST" {
+		cols, err := tx.Query(opts.Context, "SELECT "+utils.SelectSQL(schema, returning)+" FROM "+utils.QuoteTable(tableName)+" WHERE "+utils.LynxTag+" = $1 FOR UPDATE", lynxtag)
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		rows, err := encodeRows(cols, schema)
+
+		cols.Close()
+
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+
+		if len(rows) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("No row with this lynxtag exists"))
+			return
+		}
+
+		before = rows[0]
+	}
+
+	var sql string
+	var args []any
+
+	switch r.Method {
+	case "POST":
+		var cols = make([]string, len(data.Columns))
+		var params = make([]string, len(data.Columns))
+
+		for i, col := range data.Columns {
+			cols[i] = utils.QuoteColumn(col)
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+
+		sql = "INSERT INTO " + utils.QuoteTable(tableName) + " (" + strings.Join(cols, ", ") + ") VALUES (" + strings.Join(params, ", ") + ") RETURNING " + utils.SelectSQL(schema, returning)
+		args = data.Values
+	case "PATCH":
+		var sets = make([]string, len(data.Columns))
+
+		for i, col := range data.Columns {
+			sets[i] = utils.QuoteColumn(col) + " = $" + strconv.Itoa(i+1)
+		}
+
+		sql = "UPDATE " + utils.QuoteTable(tableName) + " SET " + strings.Join(sets, ", ") + " WHERE " + utils.LynxTag + " = $" + strconv.Itoa(len(data.Columns)+1) + " RETURNING " + utils.SelectSQL(schema, returning)
+		args = append(data.Values, lynxtag)
+	case "DELETE":
+		sql = "DELETE FROM " + utils.QuoteTable(tableName) + " WHERE " + utils.LynxTag + " = $1 RETURNING " + utils.SelectSQL(schema, returning)
+		args = []any{lynxtag}
+	}
+
+	cols, err := tx.Query(opts.Context, sql, args...)
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	rows, err := encodeRows(cols, schema)
+
+	cols.Close()
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if len(rows) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No row with this lynxtag exists"))
+		return
+	}
+
+	var after map[string]any
+
+	if r.Method != "DELETE" {
+		after = rows[0]
+	}
+
+	entry := utils.AuditEntry{TableName: tableName}
+
+	entry.Before, entry.After = utils.DiffRows(before, after)
+
+	if tag, ok := rows[0][utils.LynxTag].(string); ok {
+		entry.RowIDs = []string{tag}
+	}
+
+	if err := utils.WriteAudit(opts.Context, tx, auditEntry(r, auth, entry)); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	if err := tx.Commit(opts.Context); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	json.NewEncoder(w).Encode(rows[0])
+}
@@ -0,0 +1,195 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"wv2/types"
+	"wv2/utils"
+)
+
+// Registers security keys and passkeys. GET returns the options to pass to navigator.credentials.create,
+// POST takes the created credential and needs fresh MFA. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// POST takes a types.WebAuthnRegistration as its body
+func AdminWebAuthnRegister(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+
+	if r.Method == "GET" {
+		options, err := utils.WebAuthnRegistrationOptions(opts.Context, opts.DB, opts.Redis, opts.DevMode, userID)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(options)
+		return
+	}
+
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	var req types.WebAuthnRegistration
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !freshMFA(w, r, opts, auth) {
+		return
+	}
+
+	cred, err := utils.RegisterWebAuthnCredential(opts.Context, opts.DB, opts.Redis, opts.DevMode, userID, req.Name, req.Credential)
+
+	if errors.Is(err, utils.ErrInvalidWebAuthn) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: utils.WebAuthnTable, RowIDs: []string{cred.ID}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cred)
+}
+
+// Returns the options to pass to navigator.credentials.get, the assertion it creates can be sent in
+// Frostpaw-WebAuthn in place of a TOTP code. Used before login so only needs the API token. Accepts the following parameters
+//
+// - user_id -> The user ID
+func AdminWebAuthnAssert(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, err := utils.AuthorizeUser(utils.AuthRequest{
+		UserID:  r.URL.Query().Get("user_id"),
+		Token:   r.Header.Get("Authorization"),
+		DevMode: opts.DevMode,
+		Context: opts.Context,
+		DB:      opts.DB,
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if !auth.Verified || auth.Perms.Perm < 2 {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("You do not have permission to do this"))
+		return
+	}
+
+	options, err := utils.WebAuthnAssertionOptions(opts.Context, opts.DB, opts.Redis, opts.DevMode, r.URL.Query().Get("user_id"))
+
+	if errors.Is(err, utils.ErrInvalidWebAuthn) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No security keys are registered"))
+		return
+	} else if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(options)
+}
+
+// Lists (GET) or removes (DELETE, needs fresh MFA) registered security keys and passkeys. Accepts the following parameters
+//
+// - user_id -> The user ID
+//
+// - id -> The credential to remove
+func AdminWebAuthnCredentials(w http.ResponseWriter, r *http.Request, opts types.RouteInfo) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		w.Write([]byte(invalidMethod))
+		return
+	}
+
+	auth, ok := staffAccess(w, r, opts, 2)
+
+	if !ok {
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+
+	if r.Method == "GET" {
+		creds, err := utils.ListWebAuthnCredentials(opts.Context, opts.DB, userID)
+
+		if err != nil {
+			fmt.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(internalError))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(creds)
+		return
+	}
+
+	if !freshMFA(w, r, opts, auth) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+
+	deleted, err := utils.DeleteWebAuthnCredential(opts.Context, opts.DB, userID, id)
+
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(internalError))
+		return
+	}
+
+	if !deleted {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("This security key does not exist"))
+		return
+	}
+
+	audit(r, opts, auth, utils.AuditEntry{TableName: utils.WebAuthnTable, RowIDs: []string{id}})
+
+	w.Write([]byte("OK"))
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"time"
+	"wv2/utils"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/go-redis/redis/v8"
@@ -122,12 +123,18 @@ type NewStaff struct {
 
 	// TOTP image hex
 	Image string `json:"image"`
+
+	// Single-use codes that can be sent in Frostpaw-MFA in place of a TOTP code
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
 type RouteInfo struct {
 	// Postgres database
 	DB *pgxpool.Pool
 
+	// Postgres logged in as utils.ConsoleRole for the SQL console, nil if it is not set up
+	ConsoleDB *pgxpool.Pool
+
 	// Redis
 	Redis *redis.Client
 
@@ -148,3 +155,75 @@ type RouteInfo struct {
 
 	APIUrl string
 }
+
+// A bulk update or delete on a table
+type BulkRequest struct {
+	// The rows to change, required
+	Filter *utils.Filter `json:"filter"`
+
+	// The columns to set on every matched row, ignored if Delete is set
+	Set map[string]any `json:"set"`
+
+	// Delete the matched rows instead of updating them
+	Delete bool `json:"delete"`
+
+	// Only count the matched rows and return a sample of them
+	DryRun bool `json:"dry_run"`
+}
+
+// The result of a dry run bulk request
+type BulkPreview struct {
+	Count  int64            `json:"count"`
+	Cap    int64            `json:"cap"`
+	Sample []map[string]any `json:"sample"`
+}
+
+// The result of a bulk request
+type BulkResult struct {
+	Affected int64 `json:"affected"`
+}
+
+// The response of /ap/schema when constraints=true is set
+type SchemaResponse struct {
+	Columns     []utils.Schema                     `json:"columns"`
+	Constraints map[string]*utils.TableConstraints `json:"constraints"`
+}
+
+// The rows of one table related to a row, see /ap/tables/{table_name}/related
+type RelatedRows struct {
+	// Either references (the row points at these rows) or referenced_by (these rows point at the row)
+	Direction string           `json:"direction"`
+	Relation  utils.Relation   `json:"relation"`
+	Rows      []map[string]any `json:"rows"`
+}
+
+// A security key or passkey to register
+type WebAuthnRegistration struct {
+	// A name to tell the credential apart from others
+	Name string `json:"name"`
+
+	// The credential returned by navigator.credentials.create
+	Credential utils.WebAuthnResponse `json:"credential"`
+}
+
+// A query for the SQL console
+type ConsoleRequest struct {
+	Query string `json:"query"`
+}
+
+// The result of a SQL console query
+type ConsoleResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+
+	// Whether more rows were returned than the row cap allows
+	Truncated bool `json:"truncated"`
+}
+
+// A staff session as listed by /ap/sessions
+type SessionInfo struct {
+	utils.Session
+
+	// Whether this is the session the request was made with
+	Current bool `json:"current"`
+}
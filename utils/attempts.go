@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// How failed attempts of one kind (per user ID or per IP) are limited
+type attemptLimit struct {
+	kind string
+
+	// Failures allowed before locking out
+	free int64
+
+	// The first lockout, each failure after it doubles the lockout up to max
+	base time.Duration
+	max  time.Duration
+}
+
+var (
+	userAttempts = attemptLimit{kind: "user", free: 5, base: 30 * time.Second, max: time.Hour}
+
+	// Higher as many staff members can share an IP
+	ipAttempts = attemptLimit{kind: "ip", free: 20, base: 30 * time.Second, max: time.Hour}
+)
+
+// Failures are forgotten this long after the last one
+const attemptWindow = 24 * time.Hour
+
+func attemptsKey(scope string, limit attemptLimit, id string) string {
+	return "lynx_attempts:" + scope + ":" + limit.kind + ":" + id
+}
+
+func lockoutKey(scope string, limit attemptLimit, id string) string {
+	return "lynx_lockout:" + scope + ":" + limit.kind + ":" + id
+}
+
+// Reserves an attempt before its credentials are checked. A lockout refuses it without counting it,
+// otherwise the attempt is counted right away and, past the free attempts, starts the lockout a failure
+// would cause. Both happen in one call so that parallel attempts cannot get past the limit, only one
+// attempt at a time can be made once the free attempts are used up.
+//
+// KEYS: attempts key, lockout key. ARGV: free attempts, first lockout and max lockout in milliseconds,
+// attempt window in milliseconds. Returns {reserved, milliseconds} where milliseconds is the lockout left
+// if not reserved and the lockout started by the reservation (zero for none) otherwise
+var reserveScript = redis.NewScript(`
+local left = redis.call("PTTL", KEYS[2])
+
+if left > 0 then
+	return {0, left}
+end
+
+local attempts = redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+
+local free = tonumber(ARGV[1])
+
+if attempts <= free then
+	return {1, 0}
+end
+
+local lockout = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+
+for i = free + 2, attempts do
+	lockout = lockout * 2
+
+	if lockout >= max then
+		break
+	end
+end
+
+if lockout > max then
+	lockout = max
+end
+
+redis.call("SET", KEYS[2], attempts, "PX", lockout)
+return {1, lockout}
+`)
+
+// Gives back a reserved attempt, lifting the lockout it started if any (no other attempt can have been
+// reserved while it was in place). KEYS: attempts key, lockout key. ARGV: 1 if the reservation started a lockout
+var refundScript = redis.NewScript(`
+local attempts = tonumber(redis.call("GET", KEYS[1]) or "0")
+
+if attempts > 0 then
+	redis.call("DECR", KEYS[1])
+end
+
+if ARGV[1] == "1" then
+	redis.call("DEL", KEYS[2])
+end
+
+return 0
+`)
+
+// An attempt at an action counted against a user ID or an IP before its credentials are checked.
+// A failed attempt keeps it, anything else should give it back with Refund
+type Reservation struct {
+	scope string
+	limit attemptLimit
+	id    string
+
+	// The lockout this attempt started, kept if it fails. Zero if it is within the free attempts
+	Lockout time.Duration
+}
+
+func reserveAttempt(ctx context.Context, rdb *redis.Client, scope string, limit attemptLimit, id string) (*Reservation, time.Duration, error) {
+	res, err := reserveScript.Run(
+		ctx,
+		rdb,
+		[]string{attemptsKey(scope, limit, id), lockoutKey(scope, limit, id)},
+		limit.free,
+		limit.base.Milliseconds(),
+		limit.max.Milliseconds(),
+		attemptWindow.Milliseconds(),
+	).Int64Slice()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(res) != 2 {
+		return nil, 0, errors.New("unexpected reply from the attempt script")
+	}
+
+	d := time.Duration(res[1]) * time.Millisecond
+
+	if res[0] == 0 {
+		return nil, d, nil
+	}
+
+	return &Reservation{scope: scope, limit: limit, id: id, Lockout: d}, 0, nil
+}
+
+// Reserves an attempt at an action (scope) from an IP. Returns how long the IP is locked out for
+// instead if it is, in which case nothing is reserved
+func ReserveIPAttempt(ctx context.Context, rdb *redis.Client, scope, ip string) (*Reservation, time.Duration, error) {
+	return reserveAttempt(ctx, rdb, scope, ipAttempts, ip)
+}
+
+// Reserves an attempt at an action (scope) by a user ID. Returns how long the user ID is locked out for
+// instead if it is, in which case nothing is reserved
+func ReserveUserAttempt(ctx context.Context, rdb *redis.Client, scope, userID string) (*Reservation, time.Duration, error) {
+	return reserveAttempt(ctx, rdb, scope, userAttempts, userID)
+}
+
+// Gives back a reserved attempt that did not fail
+func (r *Reservation) Refund(ctx context.Context, rdb *redis.Client) error {
+	startedLockout := "0"
+
+	if r.Lockout > 0 {
+		startedLockout = "1"
+	}
+
+	return refundScript.Run(
+		ctx,
+		rdb,
+		[]string{attemptsKey(r.scope, r.limit, r.id), lockoutKey(r.scope, r.limit, r.id)},
+		startedLockout,
+	).Err()
+}
+
+// Forgets the failed attempts of a user ID after a successful attempt. Failures per IP are kept
+// so that logging into one account does not reset guessing at others
+func ClearFailures(ctx context.Context, rdb *redis.Client, scope, userID string) error {
+	return rdb.Del(ctx, attemptsKey(scope, userAttempts, userID), lockoutKey(scope, userAttempts, userID)).Err()
+}
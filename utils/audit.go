@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The table audit entries are stored in, created by the audit_log migration
+const AuditTable = "lynx_audit_log"
+
+// Anything that can run a statement, a pool or a transaction
+type Execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// A single admin panel action
+type AuditEntry struct {
+	ID int64 `json:"id"`
+
+	// The user ID of the staff member
+	Actor string `json:"actor"`
+
+	// The perm level of the staff member at the time
+	Perm float64 `json:"perm"`
+
+	// The route and method used
+	Route  string `json:"route"`
+	Method string `json:"method"`
+
+	// The table acted on, if any
+	TableName string `json:"table_name"`
+
+	// The query parameters of the request
+	Filters any `json:"filters"`
+
+	// The lynxtags of the rows acted on
+	RowIDs []string `json:"row_ids"`
+
+	// For writes, the changed columns before and after the change
+	Before any `json:"before"`
+	After  any `json:"after"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Converts a value to a JSON string for a jsonb parameter, nil stays as SQL NULL
+func jsonParam(v any) (any, error) {
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Map && reflect.ValueOf(v).IsNil()) {
+		return nil, nil
+	}
+
+	bytes, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(bytes), nil
+}
+
+// Writes an entry to the audit log. Pass a transaction to make the entry part of the change it records
+func WriteAudit(ctx context.Context, db Execer, entry AuditEntry) error {
+	var params []any
+
+	for _, v := range []any{entry.Filters, entry.Before, entry.After} {
+		p, err := jsonParam(v)
+
+		if err != nil {
+			return err
+		}
+
+		params = append(params, p)
+	}
+
+	var tableName *string
+
+	if entry.TableName != "" {
+		tableName = &entry.TableName
+	}
+
+	_, err := db.Exec(
+		ctx,
+		"INSERT INTO "+AuditTable+" (actor, perm, route, method, table_name, filters, row_ids, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		entry.Actor,
+		entry.Perm,
+		entry.Route,
+		entry.Method,
+		tableName,
+		params[0],
+		entry.RowIDs,
+		params[1],
+		params[2],
+	)
+
+	return err
+}
+
+// Returns only the columns that differ between two versions of a row
+func DiffRows(before, after map[string]any) (map[string]any, map[string]any) {
+	var b = make(map[string]any)
+	var a = make(map[string]any)
+
+	for k, v := range before {
+		if av, ok := after[k]; !ok || !reflect.DeepEqual(v, av) {
+			b[k] = v
+
+			if ok {
+				a[k] = av
+			}
+		}
+	}
+
+	for k, v := range after {
+		if _, ok := before[k]; !ok {
+			a[k] = v
+		}
+	}
+
+	if len(b) == 0 {
+		b = nil
+	}
+
+	if len(a) == 0 {
+		a = nil
+	}
+
+	return b, a
+}
+
+// Filters for querying the audit log, empty fields are ignored
+type AuditQuery struct {
+	Actor     string
+	TableName string
+	From      *time.Time
+	To        *time.Time
+
+	// Only return entries with an ID below this (for paging backwards)
+	BeforeID int64
+
+	Limit int64
+}
+
+// Queries the audit log, newest entries first
+func QueryAudit(ctx context.Context, pool *pgxpool.Pool, q AuditQuery) ([]AuditEntry, error) {
+	var conds []string
+	var args []any
+
+	if q.Actor != "" {
+		conds = append(conds, "actor = "+addArg(&args, q.Actor))
+	}
+
+	if q.TableName != "" {
+		conds = append(conds, "table_name = "+addArg(&args, q.TableName))
+	}
+
+	if q.From != nil {
+		conds = append(conds, "created_at >= "+addArg(&args, *q.From))
+	}
+
+	if q.To != nil {
+		conds = append(conds, "created_at <= "+addArg(&args, *q.To))
+	}
+
+	if q.BeforeID > 0 {
+		conds = append(conds, "id < "+addArg(&args, q.BeforeID))
+	}
+
+	sql := "SELECT id, actor, perm, route, method, COALESCE(table_name, ''), filters::text, row_ids, before::text, after::text, created_at FROM " + AuditTable
+
+	for i, cond := range conds {
+		if i == 0 {
+			sql += " WHERE " + cond
+		} else {
+			sql += " AND " + cond
+		}
+	}
+
+	sql += " ORDER BY id DESC LIMIT " + strconv.FormatInt(q.Limit, 10)
+
+	rows, err := pool.Query(ctx, sql, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var entries []AuditEntry = []AuditEntry{}
+
+	for rows.Next() {
+		var entry AuditEntry
+		var filters, before, after *string
+
+		err := rows.Scan(&entry.ID, &entry.Actor, &entry.Perm, &entry.Route, &entry.Method, &entry.TableName, &filters, &entry.RowIDs, &before, &after, &entry.CreatedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range []struct {
+			src *string
+			dst *any
+		}{{filters, &entry.Filters}, {before, &entry.Before}, {after, &entry.After}} {
+			if v.src != nil {
+				if err := json.Unmarshal([]byte(*v.src), v.dst); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errCBOR = errors.New("invalid cbor")
+
+// Decodes the first CBOR item of data, returning it and the number of bytes it took up. Only the
+// subset of CBOR used by WebAuthn is supported: integers (as int64), byte and text strings, arrays,
+// maps (as map[any]any), booleans and null. Indefinite lengths and floats are rejected
+func decodeCBOR(data []byte) (any, int, error) {
+	return decodeCBORDepth(data, 0)
+}
+
+func decodeCBORDepth(data []byte, depth int) (any, int, error) {
+	if len(data) == 0 || depth > 16 {
+		return nil, 0, errCBOR
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	pos := 1
+
+	var arg uint64
+
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+
+		if len(data) < pos+size {
+			return nil, 0, errCBOR
+		}
+
+		switch size {
+		case 1:
+			arg = uint64(data[pos])
+		case 2:
+			arg = uint64(binary.BigEndian.Uint16(data[pos:]))
+		case 4:
+			arg = uint64(binary.BigEndian.Uint32(data[pos:]))
+		case 8:
+			arg = binary.BigEndian.Uint64(data[pos:])
+		}
+
+		pos += size
+	default:
+		return nil, 0, errCBOR
+	}
+
+	switch major {
+	case 0, 1:
+		if arg > 1<<63-1 {
+			return nil, 0, errCBOR
+		}
+
+		if major == 1 {
+			return -1 - int64(arg), pos, nil
+		}
+
+		return int64(arg), pos, nil
+	case 2, 3:
+		if arg > uint64(len(data)-pos) {
+			return nil, 0, errCBOR
+		}
+
+		b := data[pos : pos+int(arg)]
+
+		if major == 3 {
+			return string(b), pos + int(arg), nil
+		}
+
+		return b, pos + int(arg), nil
+	case 4:
+		if arg > uint64(len(data)) {
+			return nil, 0, errCBOR
+		}
+
+		var arr = make([]any, 0, arg)
+
+		for i := uint64(0); i < arg; i++ {
+			v, n, err := decodeCBORDepth(data[pos:], depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			arr = append(arr, v)
+			pos += n
+		}
+
+		return arr, pos, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, 0, errCBOR
+		}
+
+		var m = make(map[any]any, arg)
+
+		for i := uint64(0); i < arg; i++ {
+			k, n, err := decodeCBORDepth(data[pos:], depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			pos += n
+
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, 0, errCBOR
+			}
+
+			v, n, err := decodeCBORDepth(data[pos:], depth+1)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			m[k] = v
+			pos += n
+		}
+
+		return m, pos, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, pos, nil
+		case 21:
+			return true, pos, nil
+		case 22:
+			return nil, pos, nil
+		}
+	}
+
+	return nil, 0, errCBOR
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want any
+		n    int
+		err  bool
+	}{
+		{name: "small uint", hex: "17", want: int64(23), n: 1},
+		{name: "uint8", hex: "1818", want: int64(24), n: 2},
+		{name: "uint16", hex: "190100", want: int64(256), n: 3},
+		{name: "uint32", hex: "1a000f4240", want: int64(1000000), n: 5},
+		{name: "uint64", hex: "1b000000e8d4a51000", want: int64(1000000000000), n: 9},
+		{name: "negative", hex: "26", want: int64(-7), n: 1},
+		{name: "negative uint16", hex: "390100", want: int64(-257), n: 3},
+		{name: "byte string", hex: "43010203", want: []byte{1, 2, 3}, n: 4},
+		{name: "text string", hex: "6461757468", want: "auth", n: 5},
+		{name: "array", hex: "83010203", want: []any{int64(1), int64(2), int64(3)}, n: 4},
+		{name: "map", hex: "a2616101200a", want: map[any]any{"a": int64(1), int64(-1): int64(10)}, n: 6},
+		{name: "nested", hex: "a1616182f5f6", want: map[any]any{"a": []any{true, nil}}, n: 6},
+		{name: "false", hex: "f4", want: false, n: 1},
+		{name: "trailing data", hex: "0102", want: int64(1), n: 1},
+		{name: "empty", hex: "", err: true},
+		{name: "truncated argument", hex: "19ff", err: true},
+		{name: "truncated string", hex: "4401", err: true},
+		{name: "truncated array", hex: "8301", err: true},
+		{name: "indefinite length", hex: "5f4101ff", err: true},
+		{name: "float", hex: "f93c00", err: true},
+		{name: "uint64 overflow", hex: "1bffffffffffffffff", err: true},
+		{name: "byte string key", hex: "a14101f5", err: true},
+		{name: "huge array length", hex: "9a7fffffff", err: true},
+		{name: "too deep", hex: "818181818181818181818181818181818101", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.hex)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, n, err := decodeCBOR(data)
+
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if n != tt.n {
+				t.Errorf("read %d bytes, want %d", n, tt.n)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// Returned by ParseColumns when every column of a table is secret, there is nothing to select
+var ErrNoColumns = errors.New("this table has no columns you can read")
+
+// Gets the columns a table read should select from the columns parameter of a request,
+// a comma separated list of column names. If columns is empty, every non-secret column is selected.
+// Returns ErrNoColumns if that leaves nothing to select
+func ParseColumns(schema []Schema, columns string) ([]string, error) {
+	var cols []string
+
+	if columns == "" {
+		for _, col := range schema {
+			if !col.Secret {
+				cols = append(cols, col.ColumnName)
+			}
+		}
+
+		if len(cols) == 0 {
+			return nil, ErrNoColumns
+		}
+
+		return cols, nil
+	}
+
+	var seen = make(map[string]bool)
+
+	for _, name := range strings.Split(columns, ",") {
+		name = strings.TrimSpace(name)
+
+		col := FindColumn(schema, name)
+
+		if col == nil || col.Secret {
+			return nil, errors.New(name + ": column does not exist")
+		}
+
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		cols = append(cols, name)
+	}
+
+	if len(cols) == 0 {
+		return nil, ErrNoColumns
+	}
+
+	return cols, nil
+}
+
+// Returns the select list for a set of columns, secret columns are never named so they never leave postgres
+// and masked columns are replaced with MaskedValue (or NULL) by postgres
+func SelectSQL(schema []Schema, cols []string) string {
+	var parts = make([]string, len(cols))
+
+	for i, name := range cols {
+		parts[i] = QuoteColumn(name)
+
+		if col := FindColumn(schema, name); col != nil && col.Masked {
+			parts[i] = "CASE WHEN " + parts[i] + " IS NULL THEN NULL ELSE '" + MaskedValue + "' END AS " + parts[i]
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The role SQL console queries run as, created by the console_role migration
+const ConsoleRole = "lynx_console"
+
+// Connects to postgres as ConsoleRole for the SQL console, with the same connection settings as the main
+// pool otherwise. Refuses to connect if the role could reach more than its own grants, as a superuser or
+// through membership of another role
+func ConnectConsole(ctx context.Context, password string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.ConnConfig.User = ConsoleRole
+	config.ConnConfig.Password = password
+	config.MaxConns = 4
+
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var privileged bool
+
+	err = pool.QueryRow(
+		ctx,
+		"SELECT r.rolsuper OR EXISTS (SELECT 1 FROM pg_auth_members m WHERE m.member = r.oid) FROM pg_roles r WHERE r.rolname = current_user",
+	).Scan(&privileged)
+
+	if err == nil && privileged {
+		err = errors.New(ConsoleRole + " must not be a superuser or a member of other roles")
+	}
+
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// The schema generation and policy the console grants were last synced for
+var consoleGrants struct {
+	sync.Mutex
+
+	synced     bool
+	generation uint64
+	policy     *Policy
+}
+
+// Makes sure ConsoleRole can read exactly the columns policy allows to be read in full: secret, hidden and
+// masked columns and tables policy cannot read get no grant, so postgres refuses any query (including
+// whole-row and computed ones) that touches them. Grants are only synced again after a schema change
+func EnsureConsoleGrants(ctx context.Context, pool *pgxpool.Pool, policy *EffectivePolicy) error {
+	consoleGrants.Lock()
+	defer consoleGrants.Unlock()
+
+	schemaCache.RLock()
+	listening, generation := schemaCache.listening, schemaCache.generation
+	schemaCache.RUnlock()
+
+	// Without the listener, schema changes cannot be seen so grants are synced every time
+	if listening && consoleGrants.synced && consoleGrants.generation == generation && consoleGrants.policy == CurrentPolicy() {
+		return nil
+	}
+
+	if err := syncConsoleGrants(ctx, pool, policy); err != nil {
+		return err
+	}
+
+	consoleGrants.synced = listening
+	consoleGrants.generation = generation
+	consoleGrants.policy = CurrentPolicy()
+
+	return nil
+}
+
+func syncConsoleGrants(ctx context.Context, pool *pgxpool.Pool, policy *EffectivePolicy) error {
+	schema, err := cachedSchema(ctx, pool, SchemaFilter{})
+
+	if err != nil {
+		return err
+	}
+
+	var schemaNames []string
+
+	rows, err := pool.Query(ctx, "SELECT n.nspname::text FROM pg_namespace n WHERE "+userSchemaSQL("n", "$1"), CurrentPolicy().BrowsableSchemas())
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+
+		schemaNames = append(schemaNames, name)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var grants = make(map[string][]string)
+	var tables []string
+
+	// Views read their tables as their owner, so views that read anything the role may not are not granted either
+	for _, col := range schema {
+		if col.Secret || !policy.CanRead(col.TableName) || policy.IsHidden(col.TableName, col.ColumnName) || policy.IsMasked(col.TableName, col.ColumnName) || !SourcesVisible(col.Sources, policy) {
+			continue
+		}
+
+		if _, ok := grants[col.TableName]; !ok {
+			tables = append(tables, col.TableName)
+		}
+
+		grants[col.TableName] = append(grants[col.TableName], QuoteColumn(col.ColumnName))
+	}
+
+	role := pgx.Identifier{ConsoleRole}.Sanitize()
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	for _, name := range schemaNames {
+		ident := pgx.Identifier{name}.Sanitize()
+
+		if _, err := tx.Exec(ctx, "REVOKE ALL ON ALL TABLES IN SCHEMA "+ident+" FROM "+role); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "GRANT USAGE ON SCHEMA "+ident+" TO "+role); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		if _, err := tx.Exec(ctx, "GRANT SELECT ("+strings.Join(grants[table], ", ")+") ON "+QuoteTable(table)+" TO "+role); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,215 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type ForeignKey struct {
+	Name          string   `json:"name"`
+	Columns       []string `json:"columns"`
+	TargetTable   string   `json:"target_table"`
+	TargetColumns []string `json:"target_columns"`
+
+	// The postgres action codes: a (no action), r (restrict), c (cascade), n (set null) or d (set default)
+	OnUpdate string `json:"on_update"`
+	OnDelete string `json:"on_delete"`
+}
+
+type UniqueConstraint struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+}
+
+type CheckConstraint struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+type Index struct {
+	Name string `json:"name"`
+
+	// The key columns, or expressions for expression indexes
+	Columns []string `json:"columns"`
+
+	Unique     bool   `json:"unique"`
+	Primary    bool   `json:"primary"`
+	Definition string `json:"definition"`
+}
+
+// The keys, constraints and indexes of a table
+type TableConstraints struct {
+	PrimaryKey  []string           `json:"primary_key"`
+	ForeignKeys []ForeignKey       `json:"foreign_keys"`
+	Unique      []UniqueConstraint `json:"unique"`
+	Checks      []CheckConstraint  `json:"checks"`
+	Indexes     []Index            `json:"indexes"`
+}
+
+// Returns SQL for the QualifiedName of a pg_class row
+func qualifiedNameSQL(namespace, class string) string {
+	return "(CASE WHEN " + namespace + ".nspname = 'public' THEN " + class + ".relname::text ELSE " + namespace + ".nspname || '.' || " + class + ".relname END)"
+}
+
+// Returns SQL that is true for a pg_namespace row of a schema in the text array param, used with BrowsableSchemas
+func userSchemaSQL(namespace, param string) string {
+	return namespace + ".nspname = ANY(" + param + "::text[])"
+}
+
+var constraintsSQL = `
+SELECT c.conname::text, c.contype::text, ` + qualifiedNameSQL("n", "t") + `,
+	ARRAY(
+		SELECT a.attname::text FROM unnest(c.conkey) WITH ORDINALITY k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum ORDER BY k.ord
+	),
+	CASE WHEN ft.oid IS NOT NULL THEN ` + qualifiedNameSQL("fn", "ft") + ` END,
+	ARRAY(
+		SELECT a.attname::text FROM unnest(c.confkey) WITH ORDINALITY k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum ORDER BY k.ord
+	),
+	c.confupdtype::text, c.confdeltype::text, pg_get_constraintdef(c.oid)
+FROM pg_constraint c
+JOIN pg_class t ON t.oid = c.conrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+LEFT JOIN pg_class ft ON ft.oid = c.confrelid
+LEFT JOIN pg_namespace fn ON fn.oid = ft.relnamespace
+WHERE ` + userSchemaSQL("n", "$1") + ` AND c.contype IN ('p', 'f', 'u', 'c')
+ORDER BY 3, c.conname
+`
+
+var indexesSQL = `
+SELECT ` + qualifiedNameSQL("n", "t") + `, i.relname::text, ix.indisunique, ix.indisprimary, pg_get_indexdef(ix.indexrelid),
+	ARRAY(SELECT pg_get_indexdef(ix.indexrelid, k, true) FROM generate_series(1, ix.indnkeyatts) k)
+FROM pg_index ix
+JOIN pg_class i ON i.oid = ix.indexrelid
+JOIN pg_class t ON t.oid = ix.indrelid
+JOIN pg_namespace n ON n.oid = t.relnamespace
+WHERE ` + userSchemaSQL("n", "$1") + `
+ORDER BY 1, i.relname
+`
+
+// Loads the constraints and indexes of every table from postgres
+func loadConstraints(ctx context.Context, pool *pgxpool.Pool) (map[string]*TableConstraints, error) {
+	var result = make(map[string]*TableConstraints)
+
+	table := func(name string) *TableConstraints {
+		if result[name] == nil {
+			result[name] = &TableConstraints{
+				PrimaryKey:  []string{},
+				ForeignKeys: []ForeignKey{},
+				Unique:      []UniqueConstraint{},
+				Checks:      []CheckConstraint{},
+				Indexes:     []Index{},
+			}
+		}
+		return result[name]
+	}
+
+	schemas := CurrentPolicy().BrowsableSchemas()
+
+	rows, err := pool.Query(ctx, constraintsSQL, schemas)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, typ, tableName, onUpdate, onDelete, definition string
+		var targetTable *string
+		var cols, targetCols []string
+
+		err := rows.Scan(&name, &typ, &tableName, &cols, &targetTable, &targetCols, &onUpdate, &onDelete, &definition)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t := table(tableName)
+
+		switch typ {
+		case "p":
+			t.PrimaryKey = cols
+		case "f":
+			fk := ForeignKey{
+				Name:          name,
+				Columns:       cols,
+				TargetColumns: targetCols,
+				OnUpdate:      onUpdate,
+				OnDelete:      onDelete,
+			}
+
+			if targetTable != nil {
+				fk.TargetTable = *targetTable
+			}
+
+			t.ForeignKeys = append(t.ForeignKeys, fk)
+		case "u":
+			t.Unique = append(t.Unique, UniqueConstraint{Name: name, Columns: cols})
+		case "c":
+			t.Checks = append(t.Checks, CheckConstraint{Name: name, Definition: definition})
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	rows, err = pool.Query(ctx, indexesSQL, schemas)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var tableName string
+		var index Index
+
+		err := rows.Scan(&tableName, &index.Name, &index.Unique, &index.Primary, &index.Definition, &index.Columns)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t := table(tableName)
+		t.Indexes = append(t.Indexes, index)
+	}
+
+	return result, rows.Err()
+}
+
+// Gets the constraints and indexes of each table, keyed by table name. Only TableName, SchemaName and
+// Policy of the filter are used, tables the policy does not allow reading are left out
+func GetConstraints(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) (map[string]*TableConstraints, error) {
+	all, err := cachedConstraints(ctx, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result = make(map[string]*TableConstraints)
+
+	for name, t := range all {
+		if opts.TableName != "" && opts.TableName != name {
+			continue
+		}
+
+		if opts.SchemaName != "" && opts.SchemaName != SchemaOf(name) {
+			continue
+		}
+
+		if opts.Policy != nil && !opts.Policy.CanRead(name) {
+			continue
+		}
+
+		result[name] = t
+	}
+
+	return result, nil
+}
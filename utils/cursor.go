@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the extra columns selected to build the next cursor of a page
+const cursorColPrefix = "_lynxcursor_"
+
+// A keyset pagination cursor, this is sent to the client as an opaque string.
+//
+// Values holds the text representation of each sort key of the last row of a page (nil for NULL),
+// the final key is always _lynxtag so every cursor points to exactly one row
+type Cursor struct {
+	Keys   []OrderKey `json:"k"`
+	Values []*string  `json:"v"`
+}
+
+// Encodes a cursor into the opaque string sent to clients
+func (c *Cursor) Encode() string {
+	bytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+// Decodes a cursor, checking that it was made for the same sort keys as the current request
+func DecodeCursor(s string, keys []OrderKey) (*Cursor, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var c Cursor
+
+	if err := json.Unmarshal(bytes, &c); err != nil || len(c.Keys) != len(c.Values) {
+		return nil, errors.New("invalid cursor")
+	}
+
+	if len(c.Keys) != len(keys) {
+		return nil, errors.New("cursor was created for a different order")
+	}
+
+	for i := range keys {
+		if c.Keys[i] != keys[i] {
+			return nil, errors.New("cursor was created for a different order")
+		}
+	}
+
+	return &c, nil
+}
+
+// Returns true if keyset pagination can be used with these sort keys
+func CursorSupported(keys []OrderKey) bool {
+	return len(keys) > 0 && keys[len(keys)-1].Column == LynxTag
+}
+
+// Returns the extra columns to select so the cursor of a page can be built from its last row
+func CursorSelect(keys []OrderKey) string {
+	var sql string
+
+	for i, key := range keys {
+		sql += ", " + QuoteColumn(key.Column) + "::text AS " + cursorColPrefix + strconv.Itoa(i)
+	}
+
+	return sql
+}
+
+// Removes the cursor columns added by CursorSelect from encoded rows, returning the cursor
+// pointing after the last row
+func CursorFromRows(rows []map[string]any, keys []OrderKey) *Cursor {
+	var c = &Cursor{Keys: keys, Values: make([]*string, len(keys))}
+
+	for i, row := range rows {
+		for j := range keys {
+			name := cursorColPrefix + strconv.Itoa(j)
+
+			if i == len(rows)-1 {
+				if v, ok := row[name].(string); ok {
+					c.Values[j] = &v
+				}
+			}
+
+			delete(row, name)
+		}
+	}
+
+	return c
+}
+
+// Converts the cursor into a SQL condition matching only rows after it, appending its parameters to args.
+//
+// This follows the default postgres NULL ordering (NULLS LAST for ascending, NULLS FIRST for descending)
+func (c *Cursor) ToSQL(schema []Schema, args *[]any) (string, error) {
+	var eqs []string
+	var ors []string
+
+	for i, key := range c.Keys {
+		col := FindColumn(schema, key.Column)
+
+		if col == nil || col.Secret {
+			return "", errors.New("invalid cursor")
+		}
+
+		name := QuoteColumn(col.ColumnName)
+		val := c.Values[i]
+
+		var eq, after string
+
+		if val == nil {
+			eq = name + " IS NULL"
+
+			if key.Desc {
+				after = name + " IS NOT NULL"
+			}
+		} else {
+			param := addArg(args, *val)
+			eq = name + " = " + param
+
+			if key.Desc {
+				after = name + " < " + param
+			} else if col.IsNullable {
+				after = "(" + name + " > " + param + " OR " + name + " IS NULL)"
+			} else {
+				after = name + " > " + param
+			}
+		}
+
+		// Nothing sorts after NULL in ascending order within equal previous keys
+		if after != "" {
+			ors = append(ors, "("+strings.Join(append(eqs, after), " AND ")+")")
+		}
+
+		eqs = append(eqs, eq)
+	}
+
+	if len(ors) == 0 {
+		return "FALSE", nil
+	}
+
+	return "(" + strings.Join(ors, " OR ") + ")", nil
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	pgxtype "github.com/jackc/pgx/v5/pgtype"
+)
+
+// Converts a single (non-array) value read from postgres into the form sent to the admin panel
+type Encoder func(val any) (any, error)
+
+// Encoders keyed by the postgres type name used in Schema.Type, types without an encoder are sent as pgx decodes them
+var encoders = map[string]Encoder{
+	"uuid":                        encodeUUID,
+	"timestamp with time zone":    encodeTimestamp,
+	"timestamp without time zone": encodeTimestamp,
+	"date":                        encodeDate,
+	"interval":                    encodeInterval,
+	"numeric":                     encodeNumeric,
+	"inet":                        encodeInet,
+	"cidr":                        encodeInet,
+	"json":                        encodeJSON,
+	"jsonb":                       encodeJSON,
+	"bigint":                      encodeBigint,
+}
+
+// Registers (or replaces) the encoder for a postgres type
+func RegisterEncoder(typ string, enc Encoder) {
+	encoders[typ] = enc
+}
+
+// UUIDs are sent in their canonical string form
+func encodeUUID(val any) (any, error) {
+	switch v := val.(type) {
+	case [16]uint8:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16]), nil
+	case string:
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("cannot encode %T as uuid", val)
+}
+
+// Timestamps are sent as RFC 3339 strings, or infinity/-infinity
+func encodeTimestamp(val any) (any, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case pgxtype.InfinityModifier:
+		return v.String(), nil
+	case string:
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("cannot encode %T as timestamp", val)
+}
+
+// Dates are sent as YYYY-MM-DD, or infinity/-infinity
+func encodeDate(val any) (any, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v.Format("2006-01-02"), nil
+	case string:
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("cannot encode %T as date", val)
+}
+
+// Intervals are sent as ISO 8601 durations such as P1M2DT3H4M5.5S
+func encodeInterval(val any) (any, error) {
+	v, ok := val.(pgxtype.Interval)
+
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as interval", val)
+	}
+
+	var b strings.Builder
+
+	b.WriteString("P")
+
+	if v.Months != 0 {
+		b.WriteString(strconv.Itoa(int(v.Months)) + "M")
+	}
+
+	if v.Days != 0 {
+		b.WriteString(strconv.Itoa(int(v.Days)) + "D")
+	}
+
+	if v.Microseconds != 0 || (v.Months == 0 && v.Days == 0) {
+		us := v.Microseconds
+		b.WriteString("T")
+
+		if h := us / int64(time.Hour/time.Microsecond); h != 0 {
+			b.WriteString(strconv.FormatInt(h, 10) + "H")
+			us -= h * int64(time.Hour/time.Microsecond)
+		}
+
+		if m := us / int64(time.Minute/time.Microsecond); m != 0 {
+			b.WriteString(strconv.FormatInt(m, 10) + "M")
+			us -= m * int64(time.Minute/time.Microsecond)
+		}
+
+		if us != 0 || b.String() == "PT" {
+			b.WriteString(strconv.FormatFloat(float64(us)/1e6, 'f', -1, 64) + "S")
+		}
+	}
+
+	return b.String(), nil
+}
+
+// Numerics are sent as strings so no precision is lost
+func encodeNumeric(val any) (any, error) {
+	v, ok := val.(pgxtype.Numeric)
+
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as numeric", val)
+	}
+
+	text, err := v.Value()
+
+	if err != nil || text == nil {
+		return nil, err
+	}
+
+	return fmt.Sprint(text), nil
+}
+
+// Network addresses are sent like postgres prints them, without a mask for single hosts
+func encodeInet(val any) (any, error) {
+	v, ok := val.(*net.IPNet)
+
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as inet", val)
+	}
+
+	if ones, bits := v.Mask.Size(); ones == bits {
+		return v.IP.String(), nil
+	}
+
+	return v.String(), nil
+}
+
+// JSON values are always sent as a JSON string, whatever their shape
+func encodeJSON(val any) (any, error) {
+	bytes, err := json.Marshal(val)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return string(bytes), nil
+}
+
+// Bigints are sent as strings as snowflakes do not fit in a javascript number
+func encodeBigint(val any) (any, error) {
+	switch v := val.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case string:
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("cannot encode %T as bigint", val)
+}
+
+// Guesses the postgres type of a value from its Go type, for values with no schema such as computed columns
+func typeOfValue(val any) string {
+	switch v := val.(type) {
+	case [16]uint8:
+		return "uuid"
+	case time.Time, pgxtype.InfinityModifier:
+		return "timestamp with time zone"
+	case pgxtype.Interval:
+		return "interval"
+	case pgxtype.Numeric:
+		return "numeric"
+	case *net.IPNet:
+		return "inet"
+	case map[string]any:
+		return "jsonb"
+	case int64:
+		// Only large values need to be strings when the type is not known
+		if v > 1<<53-1 || v < -(1<<53-1) {
+			return "bigint"
+		}
+	}
+
+	return ""
+}
+
+func encodeScalar(typ string, val any) (any, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	if typ == "" {
+		typ = typeOfValue(val)
+	}
+
+	if enc, ok := encoders[typ]; ok {
+		return enc(val)
+	}
+
+	return val, nil
+}
+
+// Converts a value read from postgres into the form sent to the admin panel.
+//
+// col is the column the value was read from, if nil the type is guessed from the value
+func EncodeValue(col *Schema, val any) (any, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	var typ string
+
+	if col != nil {
+		typ = col.Type
+
+		// JSON arrays are a single value, not a postgres array
+		if !col.Array {
+			return encodeScalar(typ, val)
+		}
+	}
+
+	elems, ok := val.([]any)
+
+	if !ok {
+		return encodeScalar(typ, val)
+	}
+
+	var out = make([]any, len(elems))
+
+	for i, elem := range elems {
+		var v any
+		var err error
+
+		if col != nil {
+			v, err = encodeScalar(typ, elem)
+		} else {
+			v, err = EncodeValue(nil, elem)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = v
+	}
+
+	return out, nil
+}
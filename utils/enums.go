@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A value a column can hold and its name
+type EnumValue struct {
+	Value any    `json:"value"`
+	Label string `json:"label"`
+}
+
+// Names for the values of int-coded columns, loaded from lynx_enums.json at startup
+type EnumConfig struct {
+	// The values of each enum, keyed by enum name
+	Enums map[string][]EnumValue `json:"enums"`
+
+	// The enum each column (as table.column) uses
+	Columns map[string]string `json:"columns"`
+}
+
+var (
+	enumConfig     = defaultEnums()
+	enumConfigLock sync.RWMutex
+)
+
+func enumValues(labels ...string) []EnumValue {
+	var values = make([]EnumValue, len(labels))
+
+	for i, label := range labels {
+		values[i] = EnumValue{Value: i, Label: label}
+	}
+
+	return values
+}
+
+// The enums used when no enum file exists, from api-docs/endpoints/enums.md
+func defaultEnums() *EnumConfig {
+	return &EnumConfig{
+		Enums: map[string][]EnumValue{
+			"LongDescriptionType": enumValues("Html", "MarkdownServerSide"),
+			"State": enumValues("Approved", "Pending", "Denied", "Hidden", "Banned", "UnderReview", "Certified",
+				"Archived", "PrivateViewable", "PrivateStaffOnly"),
+			"UserState": enumValues("Normal", "GlobalBan", "ProfileEditBan"),
+			"Flags": enumValues("Unlocked", "EditLocked", "StaffLocked", "StatsLocked", "VoteLocked", "System",
+				"WhitelistOnly", "KeepBannerDecor", "NSFW", "LoginRequired"),
+			"UserFlags": enumValues("Unknown", "VotesPrivate", "Staff", "AvidVoter"),
+			"UserExperiments": enumValues("Unknown", "GetRoleSelector", "LynxExperimentRolloutView", "BotReport",
+				"ServerAppealCertification", "UserVotePrivacy", "DevPortal"),
+			"PageStyle": enumValues("Tabs", "SingleScroll"),
+		},
+		Columns: map[string]string{
+			"bots.state":                    "State",
+			"servers.state":                 "State",
+			"users.state":                   "UserState",
+			"bots.flags":                    "Flags",
+			"servers.flags":                 "Flags",
+			"users.flags":                   "UserFlags",
+			"users.experiments":             "UserExperiments",
+			"bots.long_description_type":    "LongDescriptionType",
+			"servers.long_description_type": "LongDescriptionType",
+			"bots.page_style":               "PageStyle",
+		},
+	}
+}
+
+// Loads the enum file, keeping the default enums if it does not exist
+func LoadEnums(path string) error {
+	bytes, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var c EnumConfig
+
+	if err := json.Unmarshal(bytes, &c); err != nil {
+		return err
+	}
+
+	for col, enum := range c.Columns {
+		if parts := len(strings.Split(col, ".")); parts != 2 && parts != 3 {
+			return errors.New("enum column " + col + " must be in the form table.column or schema.table.column")
+		}
+
+		if _, ok := c.Enums[enum]; !ok {
+			return errors.New("enum column " + col + " uses the unknown enum " + enum)
+		}
+	}
+
+	enumConfigLock.Lock()
+	enumConfig = &c
+	enumConfigLock.Unlock()
+
+	return nil
+}
+
+// Returns the enum a column uses in the enum file, if any
+func columnEnum(tableName, columnName string) (string, []EnumValue) {
+	enumConfigLock.RLock()
+	defer enumConfigLock.RUnlock()
+
+	enum, ok := enumConfig.Columns[tableName+"."+columnName]
+
+	if !ok {
+		return "", nil
+	}
+
+	return enum, enumConfig.Enums[enum]
+}
+
+// Loads the labels of every postgres enum type, keyed by type name
+func loadEnums(ctx context.Context, pool *pgxpool.Pool) (map[string][]EnumValue, error) {
+	rows, err := pool.Query(ctx, "SELECT t.typname::text, e.enumlabel::text FROM pg_enum e JOIN pg_type t ON t.oid = e.enumtypid ORDER BY t.typname, e.enumsortorder")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var enums = make(map[string][]EnumValue)
+
+	for rows.Next() {
+		var typ, label string
+
+		if err := rows.Scan(&typ, &label); err != nil {
+			return nil, err
+		}
+
+		enums[typ] = append(enums[typ], EnumValue{Value: label, Label: label})
+	}
+
+	return enums, rows.Err()
+}
+
+// Returns the label of an encoded value of a column, or a list of labels for array columns.
+// Values with no label are returned as nil
+func EnumLabel(col *Schema, val any) any {
+	if col == nil || len(col.Values) == 0 || val == nil {
+		return nil
+	}
+
+	if elems, ok := val.([]any); ok && col.Array {
+		var labels = make([]any, len(elems))
+
+		for i, elem := range elems {
+			labels[i] = EnumLabel(&Schema{Values: col.Values}, elem)
+		}
+
+		return labels
+	}
+
+	// Values from postgres and from the enum file may be different number types
+	key := fmt.Sprint(val)
+
+	for _, v := range col.Values {
+		if fmt.Sprint(v.Value) == key {
+			return v.Label
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The maximum number of conditions a single filter may contain
+const maxFilterConds = 50
+
+/*
+A filter expression for the admin table browser, sent as JSON in the filter query parameter
+
+A filter is either a group of filters:
+
+	{"and": [<filter>, ...]} or {"or": [<filter>, ...]}
+
+Or a single condition on a column:
+
+	{"column": "bot_id", "op": ">=", "value": "563808552288780322"}
+
+Supported ops are =, !=, <, <=, >, >=, in, not_in, between, is_null, not_null, like and ilike.
+in and not_in take an array of values, between takes an array of exactly two values and is_null and
+not_null take no value. Values are checked against the type of the column and compared as that type
+*/
+type Filter struct {
+	And    []Filter `json:"and,omitempty"`
+	Or     []Filter `json:"or,omitempty"`
+	Column string   `json:"column,omitempty"`
+	Op     string   `json:"op,omitempty"`
+	Value  any      `json:"value,omitempty"`
+}
+
+// Parses a JSON filter expression
+func ParseFilter(s string) (*Filter, error) {
+	var f Filter
+
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+
+	if err := dec.Decode(&f); err != nil {
+		return nil, errors.New("invalid filter: " + err.Error())
+	}
+
+	return &f, nil
+}
+
+// Converts the old search_by/search_val parameters into a filter
+func LegacyFilter(searchBy, searchVal string) *Filter {
+	f := &Filter{Column: searchBy}
+
+	// Longer prefixes must be checked first
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		if strings.HasPrefix(searchVal, op) {
+			f.Op = op
+			f.Value = strings.TrimPrefix(searchVal, op)
+			return f
+		}
+	}
+
+	if searchVal == "null" {
+		f.Op = "is_null"
+		return f
+	}
+
+	f.Op = "ilike"
+	f.Value = "%" + strings.TrimPrefix(searchVal, "@") + "%"
+	return f
+}
+
+// Converts a value in a filter to the type of the column it is compared with
+func filterValue(col *Schema, val any) (any, error) {
+	if val == nil {
+		return nil, errors.New(col.ColumnName + ": use is_null or not_null to compare with null")
+	}
+
+	return ToPGValue(*col, val)
+}
+
+// Adds a parameter to args, returning its placeholder
+func addArg(args *[]any, val any) string {
+	*args = append(*args, val)
+	return "$" + strconv.Itoa(len(*args))
+}
+
+// Converts the filter into a SQL boolean expression, appending its parameters to args.
+// Placeholders are numbered after any parameters already in args
+func (f *Filter) ToSQL(schema []Schema, args *[]any) (string, error) {
+	var conds int
+	return f.toSQL(schema, args, &conds)
+}
+
+func (f *Filter) toSQL(schema []Schema, args *[]any, conds *int) (string, error) {
+	*conds++
+
+	if *conds > maxFilterConds {
+		return "", errors.New("filter has too many conditions")
+	}
+
+	if len(f.And) > 0 || len(f.Or) > 0 {
+		if f.Column != "" || (len(f.And) > 0 && len(f.Or) > 0) {
+			return "", errors.New("a filter must be exactly one of and, or or a condition")
+		}
+
+		group, joiner := f.And, " AND "
+
+		if len(f.Or) > 0 {
+			group, joiner = f.Or, " OR "
+		}
+
+		var parts = make([]string, len(group))
+
+		for i := range group {
+			part, err := group[i].toSQL(schema, args, conds)
+
+			if err != nil {
+				return "", err
+			}
+
+			parts[i] = part
+		}
+
+		return "(" + strings.Join(parts, joiner) + ")", nil
+	}
+
+	col := FindColumn(schema, f.Column)
+
+	if col == nil || col.Secret {
+		return "", errors.New(f.Column + ": column does not exist")
+	}
+
+	// Filtering on a masked column would reveal its contents
+	if col.Masked {
+		return "", errors.New(f.Column + ": column is masked")
+	}
+
+	name := QuoteColumn(col.ColumnName)
+
+	switch f.Op {
+	case "is_null":
+		return name + " IS NULL", nil
+	case "not_null":
+		return name + " IS NOT NULL", nil
+	case "like", "ilike":
+		pattern, ok := f.Value.(string)
+
+		if !ok {
+			return "", errors.New(f.Column + ": " + f.Op + " takes a string pattern")
+		}
+
+		return name + "::text " + strings.ToUpper(f.Op) + " " + addArg(args, pattern), nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		v, err := filterValue(col, f.Value)
+
+		if err != nil {
+			return "", err
+		}
+
+		return name + " " + f.Op + " " + addArg(args, v), nil
+	case "in", "not_in", "between":
+		if col.Array {
+			return "", errors.New(f.Column + ": " + f.Op + " cannot be used on array columns")
+		}
+
+		vals, ok := f.Value.([]any)
+
+		if !ok {
+			return "", errors.New(f.Column + ": " + f.Op + " takes an array of values")
+		}
+
+		if f.Op == "between" {
+			if len(vals) != 2 {
+				return "", errors.New(f.Column + ": between takes exactly two values")
+			}
+
+			low, err := filterValue(col, vals[0])
+
+			if err != nil {
+				return "", err
+			}
+
+			high, err := filterValue(col, vals[1])
+
+			if err != nil {
+				return "", err
+			}
+
+			return name + " BETWEEN " + addArg(args, low) + " AND " + addArg(args, high), nil
+		}
+
+		if len(vals) == 0 {
+			return "", errors.New(f.Column + ": " + f.Op + " needs at least one value")
+		}
+
+		// Send the values as a single array of the column type
+		arrCol := *col
+		arrCol.Array = true
+
+		arr, err := ToPGValue(arrCol, vals)
+
+		if err != nil {
+			return "", err
+		}
+
+		if f.Op == "in" {
+			return name + " = ANY(" + addArg(args, arr) + ")", nil
+		}
+
+		return "NOT (" + name + " = ANY(" + addArg(args, arr) + "))", nil
+	}
+
+	return "", errors.New(f.Column + ": unknown op " + f.Op)
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"errors"
+	"sort"
+)
+
+// The JSON Schema draft the generated documents follow, OpenAPI 3.1 uses the same dialect
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// Returned when a document is asked for a table that does not exist or cannot be read
+var ErrNoSuchTable = errors.New("this table does not exist")
+
+// Returns the JSON Schema of a single value of a postgres type, as sent by the admin panel (see EncodeValue)
+func jsonSchemaScalar(typ string) map[string]any {
+	switch typ {
+	case "smallint", "integer":
+		return map[string]any{"type": "integer"}
+	case "bigint":
+		return map[string]any{"type": "string", "pattern": "^-?[0-9]+$"}
+	case "real", "double precision":
+		return map[string]any{"type": "number"}
+	case "numeric":
+		return map[string]any{"type": "string", "pattern": "^-?[0-9]+(\\.[0-9]+)?$|^NaN$"}
+	case "boolean":
+		return map[string]any{"type": "boolean"}
+	case "json", "jsonb":
+		return map[string]any{"type": "string", "contentMediaType": "application/json"}
+	case "uuid":
+		return map[string]any{"type": "string", "format": "uuid"}
+	case "timestamp with time zone", "timestamp without time zone":
+		return map[string]any{"type": "string", "format": "date-time"}
+	case "date":
+		return map[string]any{"type": "string", "format": "date"}
+	case "interval":
+		return map[string]any{"type": "string", "format": "duration"}
+	}
+
+	return map[string]any{"type": "string"}
+}
+
+// Returns the JSON Schema of a column
+func ColumnJSONSchema(col Schema) map[string]any {
+	var s map[string]any
+
+	if col.Masked {
+		// Masked columns that are null stay null
+		if col.IsNullable {
+			s = map[string]any{"type": []any{"string", "null"}, "enum": []any{MaskedValue, nil}}
+		} else {
+			s = map[string]any{"type": "string", "const": MaskedValue}
+		}
+	} else {
+		if col.Array {
+			s = map[string]any{"type": "array", "items": jsonSchemaScalar(col.Type)}
+		} else {
+			s = jsonSchemaScalar(col.Type)
+		}
+
+		if col.IsNullable {
+			s["type"] = []any{s["type"], "null"}
+		}
+	}
+
+	// A volatile default (such as now()) has no fixed value, only x-default-sql describes it
+	if col.DefaultVal != nil && !col.DefaultVolatile && !col.Masked {
+		s["default"] = col.DefaultVal
+	}
+
+	if col.DefaultSQL != nil {
+		s["x-default-sql"] = *col.DefaultSQL
+	}
+
+	if col.ColumnName == LynxTag {
+		s["readOnly"] = true
+	}
+
+	s["x-postgres-type"] = col.Type
+
+	return s
+}
+
+// Returns the JSON Schema of a row of each table in schema, keyed by table name. Secret columns are left out
+func TableJSONSchemas(schema []Schema) map[string]map[string]any {
+	var tables = make(map[string]map[string]any)
+
+	for _, col := range schema {
+		if col.Secret {
+			continue
+		}
+
+		t, ok := tables[col.TableName]
+
+		if !ok {
+			t = map[string]any{
+				"title":                col.TableName,
+				"type":                 "object",
+				"properties":           map[string]any{},
+				"required":             []string{},
+				"additionalProperties": false,
+			}
+			tables[col.TableName] = t
+		}
+
+		t["properties"].(map[string]any)[col.ColumnName] = ColumnJSONSchema(col)
+
+		// Rows always have every column they are selected with, null or not
+		t["required"] = append(t["required"].([]string), col.ColumnName)
+	}
+
+	for _, t := range tables {
+		sort.Strings(t["required"].([]string))
+	}
+
+	return tables
+}
+
+// Returns a standalone JSON Schema document for a row of a table
+func JSONSchemaDocument(tableName string, schema []Schema) map[string]any {
+	doc, ok := TableJSONSchemas(schema)[tableName]
+
+	if !ok {
+		return nil
+	}
+
+	doc["$schema"] = JSONSchemaDialect
+	doc["$id"] = "lynx:tables/" + tableName
+
+	return doc
+}
+
+// Returns an OpenAPI 3.1 document with a component schema for a row of every table in schema
+func OpenAPIDocument(schema []Schema) map[string]any {
+	var components = make(map[string]any)
+
+	for name, t := range TableJSONSchemas(schema) {
+		components[name] = t
+	}
+
+	return map[string]any{
+		"openapi":           "3.1.0",
+		"jsonSchemaDialect": JSONSchemaDialect,
+		"info": map[string]any{
+			"title":   "Lynx tables",
+			"version": "1.0.0",
+		},
+		"paths": map[string]any{},
+		"components": map[string]any{
+			"schemas": components,
+		},
+	}
+}
+
+// Returns the document for a format (jsonschema or openapi). A jsonschema document for a single
+// table is returned if tableName is set, otherwise one per table keyed by table name
+func SchemaDocument(format, tableName string, schema []Schema) (any, error) {
+	switch format {
+	case "", "jsonschema":
+		if tableName == "" {
+			return TableJSONSchemas(schema), nil
+		}
+
+		doc := JSONSchemaDocument(tableName, schema)
+
+		if doc == nil {
+			return nil, ErrNoSuchTable
+		}
+
+		return doc, nil
+	case "openapi":
+		return OpenAPIDocument(schema), nil
+	}
+
+	return nil, errors.New("format must be jsonschema or openapi")
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Marks a TOTP code as used, returning false if it has already been used.
+//
+// Actions that need a fresh code call this so a code seen once (for example at login)
+// cannot be replayed. Codes are only valid for a short time so they are only remembered briefly
+func ConsumeTOTP(ctx context.Context, rdb *redis.Client, userID, code string) (bool, error) {
+	return rdb.SetNX(ctx, "lynx_totp_used:"+userID+":"+code, 1, 3*time.Minute).Result()
+}
+
+// The table the argon2id hashes of staff recovery codes are stored in
+const RecoveryCodeTable = "lynx_recovery_codes"
+
+// How many recovery codes a staff member gets
+const recoveryCodeCount = 10
+
+// Letters and digits that are hard to confuse with each other when written down
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+var recoveryCodeRegex = regexp.MustCompile(`^[a-z0-9]{5}-[a-z0-9]{5}$`)
+
+// Returns whether a code sent in place of a TOTP code looks like a recovery code (xxxxx-xxxxx)
+func IsRecoveryCode(code string) bool {
+	return recoveryCodeRegex.MatchString(strings.ToLower(strings.TrimSpace(code)))
+}
+
+func newRecoveryCode() (string, error) {
+	var code = make([]byte, 0, 11)
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			code = append(code, '-')
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+
+		if err != nil {
+			return "", err
+		}
+
+		code = append(code, recoveryCodeAlphabet[n.Int64()])
+	}
+
+	return string(code), nil
+}
+
+// Replaces the recovery codes of a user with new ones, returning the codes. Only their hashes are stored
+// so they cannot be shown again
+func GenerateRecoveryCodes(ctx context.Context, pool *pgxpool.Pool, userID string) ([]string, error) {
+	var codes = make([]string, recoveryCodeCount)
+	var hashes = make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		code, err := newRecoveryCode()
+
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := argon2id.CreateHash(code, argon2id.DefaultParams)
+
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = code
+		hashes[i] = hash
+	}
+
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM "+RecoveryCodeTable+" WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx, "INSERT INTO "+RecoveryCodeTable+" (user_id, code_hash) SELECT $1, unnest($2::text[])", userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+// Uses up a recovery code of a user, returning false if it is not one of their unused codes
+func UseRecoveryCode(ctx context.Context, pool *pgxpool.Pool, userID, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+
+	rows, err := pool.Query(ctx, "SELECT id, code_hash FROM "+RecoveryCodeTable+" WHERE user_id = $1", userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	var matched int64
+
+	for rows.Next() {
+		var id int64
+		var hash string
+
+		if err := rows.Scan(&id, &hash); err != nil {
+			return false, err
+		}
+
+		if match, err := argon2id.ComparePasswordAndHash(code, hash); err == nil && match {
+			matched = id
+			break
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	rows.Close()
+
+	if matched == 0 {
+		return false, nil
+	}
+
+	// Only the request that deletes the code gets to use it
+	tag, err := pool.Exec(ctx, "DELETE FROM "+RecoveryCodeTable+" WHERE id = $1", matched)
+
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// A single sort key of a table query
+type OrderKey struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+// Parses the order_by and order parameters of a table request.
+//
+// order_by is a comma separated list of columns and order is either a single direction (asc or desc)
+// applied to every column or a comma separated list with one direction per column. If the table
+// is tagged, _lynxtag is always added as the final key so rows with equal sort keys keep a stable order
+func ParseOrder(schema []Schema, orderBy, order string) ([]OrderKey, error) {
+	var keys []OrderKey
+
+	var cols []string
+	var dirs []string
+
+	if orderBy != "" {
+		cols = strings.Split(orderBy, ",")
+	}
+
+	if order != "" {
+		dirs = strings.Split(order, ",")
+	}
+
+	if len(dirs) > 1 && len(dirs) != len(cols) {
+		return nil, errors.New("order must have one direction or one direction per order_by column")
+	}
+
+	var seen = make(map[string]bool)
+
+	for i, name := range cols {
+		name = strings.TrimSpace(name)
+
+		col := FindColumn(schema, name)
+
+		// Sorting by a secret column would leak its contents through the order of rows
+		if col == nil || col.Secret {
+			return nil, errors.New(name + ": column does not exist")
+		}
+
+		if col.Masked {
+			return nil, errors.New(name + ": column is masked")
+		}
+
+		if seen[name] {
+			return nil, errors.New(name + ": column is sorted by more than once")
+		}
+
+		seen[name] = true
+
+		var dir string
+
+		if len(dirs) == 1 {
+			dir = dirs[0]
+		} else if len(dirs) > 1 {
+			dir = dirs[i]
+		}
+
+		switch strings.ToLower(strings.TrimSpace(dir)) {
+		case "", "asc":
+			keys = append(keys, OrderKey{Column: name})
+		case "desc":
+			keys = append(keys, OrderKey{Column: name, Desc: true})
+		default:
+			return nil, errors.New(dir + ": order must be asc or desc")
+		}
+	}
+
+	if !seen[LynxTag] && FindColumn(schema, LynxTag) != nil {
+		keys = append(keys, OrderKey{Column: LynxTag})
+	}
+
+	return keys, nil
+}
+
+// Returns the ORDER BY clause for a set of sort keys, or an empty string if there are none
+func OrderSQL(keys []OrderKey) string {
+	if len(keys) == 0 {
+		return ""
+	}
+
+	var parts = make([]string, len(keys))
+
+	for i, key := range keys {
+		parts[i] = QuoteColumn(key.Column)
+
+		if key.Desc {
+			parts[i] += " DESC"
+		}
+	}
+
+	return " ORDER BY " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// What masked columns are shown as
+const MaskedValue = "********"
+
+// The access given to staff at or above a perm level
+type PolicyLevel struct {
+	MinPerm float64 `json:"min_perm"`
+
+	// Tables that can be read and written, "*" allows every table
+	Readable []string `json:"readable"`
+	Writable []string `json:"writable"`
+
+	// Columns (as table.column) that are removed entirely or shown as MaskedValue
+	Hidden []string `json:"hidden"`
+	Masked []string `json:"masked"`
+}
+
+// The access policy of the admin panel, loaded from lynx_policy.json at startup
+type Policy struct {
+	// Columns (as table.column) that are never shown to anyone
+	Secret []string `json:"secret"`
+
+	// Access per perm level, the level with the highest min_perm at or below a users perm applies
+	Levels []PolicyLevel `json:"levels"`
+
+	// The postgres schemas that can be browsed at all, only public if empty. Secrets in other schemas are
+	// only protected if listed in Secret, so schemas such as auth should not be added without doing so
+	Schemas []string `json:"schemas"`
+}
+
+// The policy that applies to a single user
+type EffectivePolicy struct {
+	Perm float64 `json:"perm"`
+
+	// Empty if every table is allowed (ReadAll and WriteAll) or if none are
+	ReadableTables []string `json:"readable_tables"`
+	WritableTables []string `json:"writable_tables"`
+
+	HiddenColumns []string `json:"hidden_columns"`
+	MaskedColumns []string `json:"masked_columns"`
+
+	// Whether any table may be read or written
+	ReadAll  bool `json:"read_all"`
+	WriteAll bool `json:"write_all"`
+}
+
+var (
+	policy     = defaultPolicy()
+	policyLock sync.RWMutex
+)
+
+// The policy used when no policy file exists, this matches what used to be hard-coded
+func defaultPolicy() *Policy {
+	staffTables := []string{"reviews", "review_votes", "bot_packs", "vanity", "leave_of_absence", "user_vote_table",
+		"lynx_surveys", "lynx_survey_responses"}
+
+	return &Policy{
+		Secret: []string{
+			"bots.api_token",
+			"bots.webhook_secret",
+			"users.api_token",
+			"users.staff_password",
+			"users.totp_shared_key",
+			"users.supabase_id",
+			"servers.api_token",
+			"servers.webhook_secret",
+			"lynx_recovery_codes.code_hash",
+		},
+		Levels: []PolicyLevel{
+			{
+				MinPerm:  0,
+				Readable: staffTables,
+				Writable: staffTables,
+			},
+			{
+				MinPerm:  5,
+				Readable: []string{"*"},
+				Writable: []string{"*"},
+			},
+		},
+	}
+}
+
+// Loads the policy file, keeping the default policy if it does not exist
+func LoadPolicy(path string) error {
+	bytes, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var p Policy
+
+	if err := json.Unmarshal(bytes, &p); err != nil {
+		return err
+	}
+
+	if len(p.Levels) == 0 {
+		return errors.New("policy must have at least one level")
+	}
+
+	for _, col := range append(p.Secret, p.levelColumns()...) {
+		if parts := len(strings.Split(col, ".")); parts != 2 && parts != 3 {
+			return errors.New("policy column " + col + " must be in the form table.column or schema.table.column")
+		}
+	}
+
+	sort.Slice(p.Levels, func(i, j int) bool {
+		return p.Levels[i].MinPerm < p.Levels[j].MinPerm
+	})
+
+	policyLock.Lock()
+	policy = &p
+	policyLock.Unlock()
+
+	return nil
+}
+
+func (p *Policy) levelColumns() []string {
+	var cols []string
+
+	for _, level := range p.Levels {
+		cols = append(cols, level.Hidden...)
+		cols = append(cols, level.Masked...)
+	}
+
+	return cols
+}
+
+// Returns the postgres schemas that can be browsed
+func (p *Policy) BrowsableSchemas() []string {
+	if len(p.Schemas) == 0 {
+		return []string{"public"}
+	}
+
+	return p.Schemas
+}
+
+// Returns the loaded policy
+func CurrentPolicy() *Policy {
+	policyLock.RLock()
+	defer policyLock.RUnlock()
+	return policy
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the policy that applies to a perm level
+func (p *Policy) ForPerm(perm float64) *EffectivePolicy {
+	var e = &EffectivePolicy{
+		Perm:           perm,
+		ReadableTables: []string{},
+		WritableTables: []string{},
+		HiddenColumns:  []string{},
+		MaskedColumns:  []string{},
+	}
+
+	var level *PolicyLevel
+
+	for i := range p.Levels {
+		if p.Levels[i].MinPerm <= perm {
+			level = &p.Levels[i]
+		}
+	}
+
+	// Below every level, nothing is allowed
+	if level == nil {
+		return e
+	}
+
+	if contains(level.Readable, "*") {
+		e.ReadAll = true
+	} else {
+		e.ReadableTables = append(e.ReadableTables, level.Readable...)
+	}
+
+	if contains(level.Writable, "*") {
+		e.WriteAll = true
+	} else {
+		e.WritableTables = append(e.WritableTables, level.Writable...)
+	}
+
+	e.HiddenColumns = append(e.HiddenColumns, level.Hidden...)
+	e.MaskedColumns = append(e.MaskedColumns, level.Masked...)
+
+	return e
+}
+
+// Whether a table may be read
+func (e *EffectivePolicy) CanRead(tableName string) bool {
+	return e.ReadAll || contains(e.ReadableTables, tableName)
+}
+
+// Whether a table may be written to, only readable tables can be written to
+func (e *EffectivePolicy) CanWrite(tableName string) bool {
+	return e.CanRead(tableName) && (e.WriteAll || contains(e.WritableTables, tableName))
+}
+
+// The prefix of the tables lynx keeps its own state in (audit log, security keys, recovery codes...)
+const internalTablePrefix = "lynx_"
+
+// Whether a table is one lynx keeps its own state in, these are never written to through the panel
+func IsInternalTable(tableName string) bool {
+	return strings.HasPrefix(tableName, internalTablePrefix)
+}
+
+// Whether a column is hidden from this user
+func (e *EffectivePolicy) IsHidden(tableName, columnName string) bool {
+	return contains(e.HiddenColumns, tableName+"."+columnName)
+}
+
+// Whether a column is masked for this user
+func (e *EffectivePolicy) IsMasked(tableName, columnName string) bool {
+	return contains(e.MaskedColumns, tableName+"."+columnName)
+}
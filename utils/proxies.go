@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// Reverse proxies allowed to set X-Forwarded-For, only the local one unless configured
+	trustedProxies = []*net.IPNet{
+		{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+	}
+	trustedProxiesLock sync.RWMutex
+)
+
+// Loads the trusted proxies file, a JSON array of IPs or CIDR ranges that replaces the default of
+// loopback only. Nothing is loaded if the file does not exist
+func LoadTrustedProxies(path string) error {
+	bytes, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []string
+
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return err
+	}
+
+	proxies := make([]*net.IPNet, 0, len(entries))
+
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return errors.New("trusted proxy " + entry + " is not an IP or CIDR range")
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return errors.New("trusted proxy " + entry + " is not an IP or CIDR range")
+		}
+
+		proxies = append(proxies, ipNet)
+	}
+
+	trustedProxiesLock.Lock()
+	trustedProxies = proxies
+	trustedProxiesLock.Unlock()
+
+	return nil
+}
+
+// Returns whether an IP is a trusted reverse proxy whose X-Forwarded-For can be used
+func IsTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+
+	if parsed == nil {
+		return false
+	}
+
+	trustedProxiesLock.RLock()
+	defer trustedProxiesLock.RUnlock()
+
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// A link from the columns of one table to the columns of another, either a foreign key
+// or an implicit relation from lynx_relations.json
+type Relation struct {
+	Name          string   `json:"name"`
+	Table         string   `json:"table"`
+	Columns       []string `json:"columns"`
+	TargetTable   string   `json:"target_table"`
+	TargetColumns []string `json:"target_columns"`
+
+	// Whether this relation has no foreign key behind it
+	Implicit bool `json:"implicit"`
+}
+
+var (
+	implicitRelations     []Relation
+	implicitRelationsLock sync.RWMutex
+)
+
+// Loads the implicit relations file, a JSON array of relations. Used for columns such as snowflake IDs
+// that point at another table without a foreign key. Nothing is loaded if the file does not exist
+func LoadRelations(path string) error {
+	bytes, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var relations []Relation
+
+	if err := json.Unmarshal(bytes, &relations); err != nil {
+		return err
+	}
+
+	for i := range relations {
+		rel := &relations[i]
+
+		if rel.Table == "" || rel.TargetTable == "" || len(rel.Columns) == 0 || len(rel.Columns) != len(rel.TargetColumns) {
+			return errors.New("relation " + rel.Name + " must have a table, a target table and the same number of columns on both sides")
+		}
+
+		if rel.Name == "" {
+			rel.Name = rel.Table + "_" + rel.TargetTable
+		}
+
+		rel.Implicit = true
+	}
+
+	implicitRelationsLock.Lock()
+	implicitRelations = relations
+	implicitRelationsLock.Unlock()
+
+	return nil
+}
+
+// Gets every relation from or to a table: the ones it references and the ones referencing it
+func GetRelations(ctx context.Context, pool *pgxpool.Pool, tableName string) (references []Relation, referencedBy []Relation, err error) {
+	constraints, err := cachedConstraints(ctx, pool)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var all []Relation
+
+	for name, t := range constraints {
+		for _, fk := range t.ForeignKeys {
+			all = append(all, Relation{
+				Name:          fk.Name,
+				Table:         name,
+				Columns:       fk.Columns,
+				TargetTable:   fk.TargetTable,
+				TargetColumns: fk.TargetColumns,
+			})
+		}
+	}
+
+	implicitRelationsLock.RLock()
+	all = append(all, implicitRelations...)
+	implicitRelationsLock.RUnlock()
+
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Table != all[j].Table {
+			return all[i].Table < all[j].Table
+		}
+		return all[i].Name < all[j].Name
+	})
+
+	for _, rel := range all {
+		if rel.Table == tableName {
+			references = append(references, rel)
+		}
+
+		if rel.TargetTable == tableName {
+			referencedBy = append(referencedBy, rel)
+		}
+	}
+
+	return references, referencedBy, nil
+}
@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The column electrodragon uses to identify rows, this is never writable by staff
+const LynxTag = "_lynxtag"
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// A number decoded by a json decoder with UseNumber set
+type jsonNumber interface {
+	String() string
+	Int64() (int64, error)
+	Float64() (float64, error)
+}
+
+// Returns true if the string is a valid UUID
+func IsUUID(s string) bool {
+	return uuidRegex.MatchString(s)
+}
+
+// The kinds of table in Schema.Kind, keyed by the table_type information_schema reports
+var tableKinds = map[string]string{
+	"BASE TABLE":        "table",
+	"VIEW":              "view",
+	"MATERIALIZED VIEW": "materialized_view",
+	"FOREIGN":           "foreign_table",
+	"LOCAL TEMPORARY":   "table",
+}
+
+// Returns the name the admin panel uses for a table, tables outside the public schema are named schema.table
+func QualifiedName(schemaName, tableName string) string {
+	if schemaName == "public" {
+		return tableName
+	}
+	return schemaName + "." + tableName
+}
+
+// Returns the postgres schema of a table named by QualifiedName
+func SchemaOf(tableName string) string {
+	if schemaName, _, ok := strings.Cut(tableName, "."); ok {
+		return schemaName
+	}
+	return "public"
+}
+
+// Returns the quoted name of a table, safe for use in SQL. Names in the form schema.table are quoted as both
+func QuoteTable(tableName string) string {
+	if schemaName, name, ok := strings.Cut(tableName, "."); ok {
+		return pgx.Identifier{schemaName, name}.Sanitize()
+	}
+	return pgx.Identifier{tableName}.Sanitize()
+}
+
+// Whether rows can be written to a table, views and materialized views are read-only
+func IsWritable(schema []Schema) bool {
+	return len(schema) > 0 && schema[0].Kind == "table"
+}
+
+// Returns the quoted name of a column, safe for use in SQL
+func QuoteColumn(columnName string) string {
+	return pgx.Identifier{columnName}.Sanitize()
+}
+
+// Finds a column in a tables schema, returns nil if it does not exist
+func FindColumn(schema []Schema, columnName string) *Schema {
+	for i := range schema {
+		if schema[i].ColumnName == columnName {
+			return &schema[i]
+		}
+	}
+	return nil
+}
+
+// Converts a single (non-array) JSON value into the text representation postgres expects for the type
+func scalarToPG(typ string, val any) (string, error) {
+	switch typ {
+	case "smallint", "integer", "bigint":
+		var n int64
+		var err error
+
+		switch v := val.(type) {
+		case jsonNumber:
+			n, err = v.Int64()
+		case float64:
+			if v != math.Trunc(v) {
+				return "", errors.New("expected an integer")
+			}
+			n = int64(v)
+		case string:
+			// Snowflakes are sent as strings as they do not fit in a javascript number
+			n, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return "", errors.New("expected an integer")
+		}
+
+		if err != nil {
+			return "", errors.New("expected an integer")
+		}
+
+		if typ == "smallint" && (n < math.MinInt16 || n > math.MaxInt16) {
+			return "", errors.New("integer out of range for smallint")
+		} else if typ == "integer" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return "", errors.New("integer out of range for integer")
+		}
+
+		return strconv.FormatInt(n, 10), nil
+	case "real", "double precision", "numeric":
+		switch v := val.(type) {
+		case jsonNumber:
+			if _, err := v.Float64(); err != nil {
+				return "", errors.New("expected a number")
+			}
+			return v.String(), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case string:
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return "", errors.New("expected a number")
+			}
+			return v, nil
+		default:
+			return "", errors.New("expected a number")
+		}
+	case "boolean":
+		switch v := val.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			// Filters from query parameters send booleans as strings
+			b, err := strconv.ParseBool(v)
+
+			if err != nil {
+				return "", errors.New("expected a boolean")
+			}
+
+			return strconv.FormatBool(b), nil
+		default:
+			return "", errors.New("expected a boolean")
+		}
+	case "json", "jsonb":
+		bytes, err := json.Marshal(val)
+
+		if err != nil {
+			return "", err
+		}
+
+		return string(bytes), nil
+	}
+
+	// Everything else must be sent as a string
+	v, ok := val.(string)
+
+	if !ok {
+		return "", errors.New("expected a string")
+	}
+
+	switch typ {
+	case "uuid":
+		if !IsUUID(v) {
+			return "", errors.New("expected a uuid")
+		}
+	case "timestamp with time zone", "timestamp without time zone":
+		if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+			if _, err := time.Parse("2006-01-02T15:04:05.999999999", v); err != nil {
+				return "", errors.New("expected an RFC 3339 timestamp")
+			}
+		}
+	case "date":
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return "", errors.New("expected a date in the form YYYY-MM-DD")
+		}
+	case "inet", "cidr":
+		if net.ParseIP(v) == nil {
+			if _, _, err := net.ParseCIDR(v); err != nil {
+				return "", errors.New("expected an IP address")
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// Quotes a value for use inside a postgres array literal
+func quoteArrayElem(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// Converts a JSON value into the text representation postgres expects for a column.
+//
+// The returned value is either nil (SQL NULL) or a string. pgx sends strings in the
+// text format so postgres parses them as the type of the column they are compared with
+// or written to, this means bigint snowflakes never lose precision
+func ToPGValue(col Schema, val any) (any, error) {
+	if val == nil {
+		if !col.IsNullable {
+			return nil, errors.New(col.ColumnName + ": column is not nullable")
+		}
+		return nil, nil
+	}
+
+	if !col.Array {
+		v, err := scalarToPG(col.Type, val)
+
+		if err != nil {
+			return nil, errors.New(col.ColumnName + ": " + err.Error())
+		}
+
+		return v, nil
+	}
+
+	elems, ok := val.([]any)
+
+	if !ok {
+		return nil, errors.New(col.ColumnName + ": expected an array")
+	}
+
+	var parts = make([]string, len(elems))
+
+	for i, elem := range elems {
+		if elem == nil {
+			parts[i] = "NULL"
+			continue
+		}
+
+		v, err := scalarToPG(col.Type, elem)
+
+		if err != nil {
+			return nil, errors.New(col.ColumnName + "[" + strconv.Itoa(i) + "]: " + err.Error())
+		}
+
+		parts[i] = quoteArrayElem(v)
+	}
+
+	return "{" + strings.Join(parts, ",") + "}", nil
+}
+
+// A validated set of column values that can be written to a table
+type RowData struct {
+	Columns []string
+	Values  []any
+}
+
+// Validates a JSON payload against the schema of a table.
+//
+// If partial is false, every non-nullable column without a default must be present (an insert),
+// otherwise only the columns in the payload are checked (an update)
+func ValidateRow(schema []Schema, payload map[string]any, partial bool) (*RowData, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("no columns provided")
+	}
+
+	var data RowData
+
+	for name := range payload {
+		data.Columns = append(data.Columns, name)
+	}
+
+	// Keep the generated SQL stable
+	sort.Strings(data.Columns)
+
+	for _, name := range data.Columns {
+		col := FindColumn(schema, name)
+
+		if col == nil {
+			return nil, errors.New(name + ": column does not exist")
+		}
+
+		if col.Secret || col.Masked {
+			return nil, errors.New(name + ": column cannot be written to")
+		}
+
+		if name == LynxTag {
+			return nil, errors.New(name + ": column is managed by electrodragon")
+		}
+
+		v, err := ToPGValue(*col, payload[name])
+
+		if err != nil {
+			return nil, err
+		}
+
+		data.Values = append(data.Values, v)
+	}
+
+	if !partial {
+		for _, col := range schema {
+			if col.IsNullable || col.DefaultSQL != nil {
+				continue
+			}
+
+			if _, ok := payload[col.ColumnName]; !ok {
+				return nil, errors.New(col.ColumnName + ": column is required")
+			}
+		}
+	}
+
+	return &data, nil
+}
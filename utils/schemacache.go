@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The channel the DDL event trigger notifies on
+const schemaChannel = "lynx_schema_changed"
+
+// Sends a notification on schemaChannel after any DDL command. Installing an event trigger needs superuser
+const schemaTriggerSQL = `
+CREATE OR REPLACE FUNCTION lynx_notify_schema_changed() RETURNS event_trigger LANGUAGE plpgsql AS $$
+BEGIN
+	PERFORM pg_notify('` + schemaChannel + `', tg_tag);
+END;
+$$;
+DROP EVENT TRIGGER IF EXISTS lynx_schema_changed;
+CREATE EVENT TRIGGER lynx_schema_changed ON ddl_command_end EXECUTE FUNCTION lynx_notify_schema_changed();
+`
+
+// The schema of every table, kept until a DDL command changes it
+var schemaCache struct {
+	sync.RWMutex
+
+	// Whether the listener is connected, the cache cannot be trusted otherwise
+	listening bool
+
+	data []Schema
+
+	constraints map[string]*TableConstraints
+
+	// Bumped on every invalidation so a load that raced with a DDL command is not cached
+	generation uint64
+}
+
+// Drops the cached schema and constraints so the next call reloads them
+func InvalidateSchema() {
+	schemaCache.Lock()
+	schemaCache.data = nil
+	schemaCache.constraints = nil
+	schemaCache.generation++
+	schemaCache.Unlock()
+}
+
+// Installs the DDL event trigger and listens for schema changes until ctx is done.
+//
+// Until this has connected (or if the trigger cannot be installed), GetSchema always reads from postgres,
+// loading only the tables asked for
+func StartSchemaListener(ctx context.Context, pool *pgxpool.Pool) {
+	if _, err := pool.Exec(ctx, schemaTriggerSQL); err != nil {
+		fmt.Println("Could not install schema event trigger, schema caching is disabled:", err)
+		return
+	}
+
+	go func() {
+		for ctx.Err() == nil {
+			err := listenSchema(ctx, pool)
+
+			schemaCache.Lock()
+			schemaCache.listening = false
+			schemaCache.Unlock()
+
+			InvalidateSchema()
+
+			fmt.Println("Schema listener stopped, reconnecting:", err)
+
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func listenSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// The connection is left in LISTEN mode, so it must not go back to the pool
+	pgConn := conn.Hijack()
+
+	defer pgConn.Close(context.Background())
+
+	if _, err := pgConn.Exec(ctx, "LISTEN "+schemaChannel); err != nil {
+		return err
+	}
+
+	schemaCache.Lock()
+	schemaCache.listening = true
+	schemaCache.Unlock()
+
+	InvalidateSchema()
+
+	for {
+		n, err := pgConn.WaitForNotification(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		// Syncing the console grants fires the trigger too, grants do not change the schema
+		if n.Payload == "GRANT" || n.Payload == "REVOKE" {
+			continue
+		}
+
+		fmt.Println("Schema changed by", n.Payload)
+
+		InvalidateSchema()
+	}
+}
+
+// Gets the schema of every table, from the cache when possible. Without the listener nothing is cached,
+// so only the table or postgres schema in opts is loaded
+func cachedSchema(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) ([]Schema, error) {
+	schemaCache.RLock()
+	listening, data, generation := schemaCache.listening, schemaCache.data, schemaCache.generation
+	schemaCache.RUnlock()
+
+	if data != nil {
+		return data, nil
+	}
+
+	if !listening {
+		return loadSchema(ctx, pool, opts)
+	}
+
+	data, err := loadSchema(ctx, pool, SchemaFilter{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	schemaCache.Lock()
+
+	if schemaCache.listening && schemaCache.generation == generation {
+		schemaCache.data = data
+	}
+
+	schemaCache.Unlock()
+
+	return data, nil
+}
+
+// Gets the constraints and indexes of every table, from the cache when possible
+func cachedConstraints(ctx context.Context, pool *pgxpool.Pool) (map[string]*TableConstraints, error) {
+	schemaCache.RLock()
+	listening, data, generation := schemaCache.listening, schemaCache.constraints, schemaCache.generation
+	schemaCache.RUnlock()
+
+	if data != nil {
+		return data, nil
+	}
+
+	data, err := loadConstraints(ctx, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if listening {
+		schemaCache.Lock()
+
+		if schemaCache.listening && schemaCache.generation == generation {
+			schemaCache.constraints = data
+		}
+
+		schemaCache.Unlock()
+	}
+
+	return data, nil
+}
+
+// Gets the schema of the database, filtered by opts
+func GetSchema(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) ([]Schema, error) {
+	all, err := cachedSchema(ctx, pool, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Schema
+
+	for _, schema := range all {
+		if opts.TableName != "" && opts.TableName != schema.TableName {
+			continue
+		}
+
+		if opts.SchemaName != "" && opts.SchemaName != schema.SchemaName {
+			continue
+		}
+
+		if len(schema.Sources) > 0 && !SourcesVisible(schema.Sources, opts.Policy) {
+			continue
+		}
+
+		if opts.Policy != nil {
+			if !opts.Policy.CanRead(schema.TableName) {
+				continue
+			}
+
+			schema.Secret = schema.Secret || opts.Policy.IsHidden(schema.TableName, schema.ColumnName)
+			schema.Masked = !schema.Secret && opts.Policy.IsMasked(schema.TableName, schema.ColumnName)
+		}
+
+		if schema.EnumType == "" {
+			schema.EnumType, schema.Values = columnEnum(schema.TableName, schema.ColumnName)
+		}
+
+		result = append(result, schema)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// How long a staff session lasts without any requests
+	sessionIdleTimeout = 30 * time.Minute
+
+	// How long a staff session lasts after login, however active it is
+	sessionMaxLifetime = 12 * time.Hour
+)
+
+// A staff login session. Sessions are stored under a hash of their session ID so that
+// listing them never reveals a usable ID
+type Session struct {
+	// The hash of the session ID, used to refer to the session when listing or revoking it
+	ID string `json:"id"`
+
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+
+	// When the session expires if it is not used again
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// The API token the session was created with, a session is only valid with this token
+	Token string `json:"-"`
+}
+
+// A session as stored in redis
+type sessionRecord struct {
+	Session
+	Token string `json:"token"`
+}
+
+func sessionKey(id string) string {
+	return "lynx_session:" + id
+}
+
+// The set of session IDs (hashes) of a user
+func userSessionsKey(userID string) string {
+	return "lynx_sessions:" + userID
+}
+
+// Returns the ID a session is stored under
+func sessionHash(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func saveSession(ctx context.Context, rdb *redis.Client, s *Session, ttl time.Duration) error {
+	bytes, err := json.Marshal(sessionRecord{Session: *s, Token: s.Token})
+
+	if err != nil {
+		return err
+	}
+
+	return rdb.Set(ctx, sessionKey(s.ID), bytes, ttl).Err()
+}
+
+// Returns a new random session ID
+func newSessionID() (string, error) {
+	var b = make([]byte, 64)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Returns when a session last seen at lastSeen expires, the idle timeout capped by the absolute lifetime
+func sessionExpiry(createdAt, lastSeen time.Time) time.Time {
+	idle := lastSeen.Add(sessionIdleTimeout)
+	max := createdAt.Add(sessionMaxLifetime)
+
+	if idle.After(max) {
+		return max
+	}
+
+	return idle
+}
+
+// Creates a session for a user, returning the session ID to send to the panel
+func CreateSession(ctx context.Context, rdb *redis.Client, userID, token, ip, userAgent string) (string, *Session, error) {
+	sessionID, err := newSessionID()
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+
+	s := &Session{
+		ID:        sessionHash(sessionID),
+		UserID:    userID,
+		CreatedAt: now,
+		LastSeen:  now,
+		IP:        ip,
+		UserAgent: userAgent,
+		ExpiresAt: sessionExpiry(now, now),
+		Token:     token,
+	}
+
+	if err := saveSession(ctx, rdb, s, time.Until(s.ExpiresAt)); err != nil {
+		return "", nil, err
+	}
+
+	if err := rdb.SAdd(ctx, userSessionsKey(userID), s.ID).Err(); err != nil {
+		return "", nil, err
+	}
+
+	return sessionID, s, nil
+}
+
+// Gets a session by its ID (the hash of the session ID), returns nil if it does not exist or has expired
+func getSession(ctx context.Context, rdb *redis.Client, id string) (*Session, error) {
+	data, err := rdb.Get(ctx, sessionKey(id)).Bytes()
+
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var record sessionRecord
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	record.Session.Token = record.Token
+
+	return &record.Session, nil
+}
+
+// Gets the session of a session ID sent by the panel, returns nil if it does not exist or has expired
+func GetSession(ctx context.Context, rdb *redis.Client, sessionID string) (*Session, error) {
+	return getSession(ctx, rdb, sessionHash(sessionID))
+}
+
+// Returned when a session has expired or been revoked
+var ErrSessionExpired = errors.New("session expired")
+
+// Marks a session as used, extending its idle timeout up to its absolute lifetime. Returns
+// ErrSessionExpired if the session has reached its lifetime or is gone
+func TouchSession(ctx context.Context, rdb *redis.Client, s *Session) error {
+	s.LastSeen = time.Now()
+	s.ExpiresAt = sessionExpiry(s.CreatedAt, s.LastSeen)
+
+	ttl := time.Until(s.ExpiresAt)
+
+	if ttl <= 0 {
+		return ErrSessionExpired
+	}
+
+	bytes, err := json.Marshal(sessionRecord{Session: *s, Token: s.Token})
+
+	if err != nil {
+		return err
+	}
+
+	ok, err := rdb.SetXX(ctx, sessionKey(s.ID), bytes, ttl).Result()
+
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if !ok {
+		return ErrSessionExpired
+	}
+
+	return nil
+}
+
+// Moves a session to a new ID and updates the index of its user, doing nothing (and returning 0)
+// if the old session is gone
+var rotateSessionScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+redis.call("SET", KEYS[2], ARGV[1], "PX", ARGV[2])
+redis.call("SREM", KEYS[3], ARGV[3])
+redis.call("SADD", KEYS[3], ARGV[4])
+return 1
+`)
+
+// Replaces the ID of a session with a new one, returning the new session ID. The old ID stops working
+// and the absolute lifetime of the session is kept. Returns ErrSessionExpired if the session is gone
+func RotateSession(ctx context.Context, rdb *redis.Client, s *Session) (string, error) {
+	sessionID, err := newSessionID()
+
+	if err != nil {
+		return "", err
+	}
+
+	oldID := s.ID
+
+	s.ID = sessionHash(sessionID)
+
+	bytes, err := json.Marshal(sessionRecord{Session: *s, Token: s.Token})
+
+	if err != nil {
+		return "", err
+	}
+
+	ttl := time.Until(s.ExpiresAt)
+
+	if ttl <= 0 {
+		return "", ErrSessionExpired
+	}
+
+	// The session may have been revoked or have expired since it was read
+	rotated, err := rotateSessionScript.Run(ctx, rdb,
+		[]string{sessionKey(oldID), sessionKey(s.ID), userSessionsKey(s.UserID)},
+		bytes, ttl.Milliseconds(), oldID, s.ID,
+	).Int()
+
+	if err != nil {
+		return "", err
+	}
+
+	if rotated == 0 {
+		return "", ErrSessionExpired
+	}
+
+	return sessionID, nil
+}
+
+// Lists the sessions of a user, oldest first. Expired sessions are removed from the index
+func ListSessions(ctx context.Context, rdb *redis.Client, userID string) ([]Session, error) {
+	ids, err := rdb.SMembers(ctx, userSessionsKey(userID)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions = []Session{}
+
+	for _, id := range ids {
+		s, err := getSession(ctx, rdb, id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if s == nil {
+			rdb.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+
+		sessions = append(sessions, *s)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	return sessions, nil
+}
+
+// Revokes a session of a user by its ID (the hash of the session ID). Returns false if it did not exist
+func RevokeSession(ctx context.Context, rdb *redis.Client, userID, id string) (bool, error) {
+	removed, err := rdb.SRem(ctx, userSessionsKey(userID), id).Result()
+
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	return true, rdb.Del(ctx, sessionKey(id)).Err()
+}
+
+// Revokes every session of a user, returning how many were revoked
+func RevokeAllSessions(ctx context.Context, rdb *redis.Client, userID string) (int, error) {
+	ids, err := rdb.SMembers(ctx, userSessionsKey(userID)).Result()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var keys = []string{userSessionsKey(userID)}
+
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+
+	if err := rdb.Del(ctx, keys...).Err(); err != nil {
+		return 0, err
+	}
+
+	return len(ids), nil
+}
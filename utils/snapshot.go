@@ -0,0 +1,401 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The table schema snapshots are stored in, created by the schema_snapshots migration
+const SnapshotTable = "lynx_schema_snapshots"
+
+// Returned when a snapshot is neither an ID nor live
+var ErrInvalidSnapshot = errors.New("a snapshot must be an ID or live")
+
+// The schema of the database at a point in time. Live snapshots (taken but not stored) have an ID of 0
+type SchemaSnapshot struct {
+	ID        int64     `json:"id"`
+	Label     string    `json:"label"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Left out when listing snapshots
+	Columns     []Schema                     `json:"columns,omitempty"`
+	Constraints map[string]*TableConstraints `json:"constraints,omitempty"`
+}
+
+// Returns the current schema of the database as an unsaved snapshot
+func LiveSnapshot(ctx context.Context, pool *pgxpool.Pool) (*SchemaSnapshot, error) {
+	columns, err := cachedSchema(ctx, pool, SchemaFilter{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	constraints, err := cachedConstraints(ctx, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SchemaSnapshot{
+		Label:       "live",
+		CreatedAt:   time.Now(),
+		Columns:     columns,
+		Constraints: constraints,
+	}, nil
+}
+
+// Stores the current schema of the database as a new snapshot
+func TakeSnapshot(ctx context.Context, pool *pgxpool.Pool, label, createdBy string) (*SchemaSnapshot, error) {
+	snap, err := LiveSnapshot(ctx, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	snap.Label = label
+	snap.CreatedBy = createdBy
+
+	columns, err := jsonParam(snap.Columns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	constraints, err := jsonParam(snap.Constraints)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = pool.QueryRow(
+		ctx,
+		"INSERT INTO "+SnapshotTable+" (label, created_by, columns, constraints) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+		label,
+		createdBy,
+		columns,
+		constraints,
+	).Scan(&snap.ID, &snap.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+// Lists the stored snapshots without their contents, newest first
+func ListSnapshots(ctx context.Context, pool *pgxpool.Pool) ([]SchemaSnapshot, error) {
+	rows, err := pool.Query(ctx, "SELECT id, label, created_by, created_at FROM "+SnapshotTable+" ORDER BY id DESC")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var snaps = []SchemaSnapshot{}
+
+	for rows.Next() {
+		var snap SchemaSnapshot
+
+		if err := rows.Scan(&snap.ID, &snap.Label, &snap.CreatedBy, &snap.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		snaps = append(snaps, snap)
+	}
+
+	return snaps, rows.Err()
+}
+
+// Gets a stored snapshot, returns pgx.ErrNoRows if it does not exist
+func GetSnapshot(ctx context.Context, pool *pgxpool.Pool, id int64) (*SchemaSnapshot, error) {
+	var snap SchemaSnapshot
+	var columns, constraints string
+
+	err := pool.QueryRow(
+		ctx,
+		"SELECT id, label, created_by, created_at, columns::text, constraints::text FROM "+SnapshotTable+" WHERE id = $1",
+		id,
+	).Scan(&snap.ID, &snap.Label, &snap.CreatedBy, &snap.CreatedAt, &columns, &constraints)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(columns), &snap.Columns); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(constraints), &snap.Constraints); err != nil {
+		return nil, err
+	}
+
+	return &snap, nil
+}
+
+// A change to a column between two snapshots
+type ColumnChange struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+
+	// One of added, removed, retyped, default or nullability
+	Kind string `json:"kind"`
+
+	// The old and new type, default SQL or nullability, unset for added and removed columns
+	From any `json:"from,omitempty"`
+	To   any `json:"to,omitempty"`
+}
+
+// A constraint or index added, removed or changed between two snapshots
+type ConstraintChange struct {
+	Table string `json:"table"`
+	Name  string `json:"name"`
+
+	// One of primary_key, foreign_key, unique, check or index
+	Type string `json:"type"`
+
+	// One of added, removed or changed
+	Kind string `json:"kind"`
+
+	// The old and new definition, only set for changed constraints
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// The differences between two snapshots
+type SchemaDiff struct {
+	From *SchemaSnapshot `json:"from"`
+	To   *SchemaSnapshot `json:"to"`
+
+	AddedTables   []string           `json:"added_tables"`
+	RemovedTables []string           `json:"removed_tables"`
+	Columns       []ColumnChange     `json:"columns"`
+	Constraints   []ConstraintChange `json:"constraints"`
+}
+
+func columnType(col Schema) string {
+	typ := col.Type
+
+	// Postgres enums are all USER-DEFINED, the enum type tells them apart
+	if col.EnumType != "" {
+		typ = col.EnumType
+	}
+
+	if col.Array {
+		return typ + "[]"
+	}
+	return typ
+}
+
+func defaultSQL(col Schema) any {
+	if col.DefaultSQL == nil {
+		return nil
+	}
+	return *col.DefaultSQL
+}
+
+// The type and definition of a constraint or index
+type constraintDef struct {
+	typ string
+	def string
+}
+
+// Returns every constraint and index of a table by name
+func constraintDefs(t *TableConstraints) map[string]constraintDef {
+	var defs = make(map[string]constraintDef)
+
+	if t == nil {
+		return defs
+	}
+
+	for _, fk := range t.ForeignKeys {
+		defs[fk.Name] = constraintDef{
+			typ: "foreign_key",
+			def: "(" + strings.Join(fk.Columns, ", ") + ") REFERENCES " + fk.TargetTable + " (" + strings.Join(fk.TargetColumns, ", ") + ") ON UPDATE " + fk.OnUpdate + " ON DELETE " + fk.OnDelete,
+		}
+	}
+
+	for _, u := range t.Unique {
+		defs[u.Name] = constraintDef{typ: "unique", def: "(" + strings.Join(u.Columns, ", ") + ")"}
+	}
+
+	for _, c := range t.Checks {
+		defs[c.Name] = constraintDef{typ: "check", def: c.Definition}
+	}
+
+	for _, i := range t.Indexes {
+		// Primary key and unique constraints are backed by an index of the same name, which also defines them
+		if d, ok := defs[i.Name]; ok {
+			d.def += " USING " + i.Definition
+			defs[i.Name] = d
+		} else if i.Primary {
+			defs[i.Name] = constraintDef{typ: "primary_key", def: i.Definition}
+		} else {
+			defs[i.Name] = constraintDef{typ: "index", def: i.Definition}
+		}
+	}
+
+	return defs
+}
+
+// Compares two snapshots. Only tables accepted by include are compared, pass nil to compare every table
+func DiffSnapshots(from, to *SchemaSnapshot, include func(tableName string) bool) *SchemaDiff {
+	var diff = &SchemaDiff{
+		AddedTables:   []string{},
+		RemovedTables: []string{},
+		Columns:       []ColumnChange{},
+		Constraints:   []ConstraintChange{},
+	}
+
+	// The contents of the snapshots are not sent back
+	diff.From = &SchemaSnapshot{ID: from.ID, Label: from.Label, CreatedBy: from.CreatedBy, CreatedAt: from.CreatedAt}
+	diff.To = &SchemaSnapshot{ID: to.ID, Label: to.Label, CreatedBy: to.CreatedBy, CreatedAt: to.CreatedAt}
+
+	type key struct{ table, column string }
+
+	var fromCols = make(map[key]Schema)
+	var fromTables = make(map[string]bool)
+	var toTables = make(map[string]bool)
+
+	for _, col := range from.Columns {
+		if include == nil || include(col.TableName) {
+			fromCols[key{col.TableName, col.ColumnName}] = col
+			fromTables[col.TableName] = true
+		}
+	}
+
+	for _, col := range to.Columns {
+		if include != nil && !include(col.TableName) {
+			continue
+		}
+
+		toTables[col.TableName] = true
+
+		old, ok := fromCols[key{col.TableName, col.ColumnName}]
+
+		if !ok {
+			diff.Columns = append(diff.Columns, ColumnChange{Table: col.TableName, Column: col.ColumnName, Kind: "added"})
+			continue
+		}
+
+		delete(fromCols, key{col.TableName, col.ColumnName})
+
+		if columnType(old) != columnType(col) {
+			diff.Columns = append(diff.Columns, ColumnChange{Table: col.TableName, Column: col.ColumnName, Kind: "retyped", From: columnType(old), To: columnType(col)})
+		}
+
+		if defaultSQL(old) != defaultSQL(col) {
+			diff.Columns = append(diff.Columns, ColumnChange{Table: col.TableName, Column: col.ColumnName, Kind: "default", From: defaultSQL(old), To: defaultSQL(col)})
+		}
+
+		if old.IsNullable != col.IsNullable {
+			diff.Columns = append(diff.Columns, ColumnChange{Table: col.TableName, Column: col.ColumnName, Kind: "nullability", From: old.IsNullable, To: col.IsNullable})
+		}
+	}
+
+	for k := range fromCols {
+		diff.Columns = append(diff.Columns, ColumnChange{Table: k.table, Column: k.column, Kind: "removed"})
+	}
+
+	for name := range toTables {
+		if !fromTables[name] {
+			diff.AddedTables = append(diff.AddedTables, name)
+		}
+	}
+
+	for name := range fromTables {
+		if !toTables[name] {
+			diff.RemovedTables = append(diff.RemovedTables, name)
+		}
+	}
+
+	for name := range mergeKeys(from.Constraints, to.Constraints) {
+		if include != nil && !include(name) {
+			continue
+		}
+
+		oldDefs, newDefs := constraintDefs(from.Constraints[name]), constraintDefs(to.Constraints[name])
+
+		for c, d := range newDefs {
+			old, ok := oldDefs[c]
+
+			if !ok {
+				diff.Constraints = append(diff.Constraints, ConstraintChange{Table: name, Name: c, Type: d.typ, Kind: "added"})
+			} else if old != d {
+				diff.Constraints = append(diff.Constraints, ConstraintChange{Table: name, Name: c, Type: d.typ, Kind: "changed", From: old.def, To: d.def})
+			}
+		}
+
+		for c, d := range oldDefs {
+			if _, ok := newDefs[c]; !ok {
+				diff.Constraints = append(diff.Constraints, ConstraintChange{Table: name, Name: c, Type: d.typ, Kind: "removed"})
+			}
+		}
+	}
+
+	sort.Strings(diff.AddedTables)
+	sort.Strings(diff.RemovedTables)
+
+	sort.SliceStable(diff.Columns, func(i, j int) bool {
+		a, b := diff.Columns[i], diff.Columns[j]
+
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+
+		return a.Kind < b.Kind
+	})
+
+	sort.SliceStable(diff.Constraints, func(i, j int) bool {
+		a, b := diff.Constraints[i], diff.Constraints[j]
+
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+
+		return a.Name < b.Name
+	})
+
+	return diff
+}
+
+func mergeKeys(a, b map[string]*TableConstraints) map[string]bool {
+	var keys = make(map[string]bool)
+
+	for k := range a {
+		keys[k] = true
+	}
+
+	for k := range b {
+		keys[k] = true
+	}
+
+	return keys
+}
+
+// Gets a snapshot by its ID, or the live schema if ref is live
+func FindSnapshot(ctx context.Context, pool *pgxpool.Pool, ref string) (*SchemaSnapshot, error) {
+	if ref == "live" {
+		return LiveSnapshot(ctx, pool)
+	}
+
+	id, err := strconv.ParseInt(ref, 10, 64)
+
+	if err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+
+	return GetSnapshot(ctx, pool, id)
+}
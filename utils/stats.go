@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The usage of a single index
+type IndexStats struct {
+	Name string `json:"name"`
+
+	// The size of the index in bytes
+	Size int64 `json:"size"`
+
+	// The number of index scans and the rows they returned and fetched
+	Scans         int64 `json:"scans"`
+	TuplesRead    int64 `json:"tuples_read"`
+	TuplesFetched int64 `json:"tuples_fetched"`
+}
+
+// The size and health of a table
+type TableStats struct {
+	TableName string `json:"table_name"`
+
+	// The row count estimated by the planner, -1 if the table has never been analyzed
+	EstimatedRows int64 `json:"estimated_rows"`
+
+	// Sizes in bytes, table_size includes TOAST but not indexes
+	TableSize int64 `json:"table_size"`
+	IndexSize int64 `json:"index_size"`
+	TotalSize int64 `json:"total_size"`
+
+	LiveTuples int64 `json:"live_tuples"`
+	DeadTuples int64 `json:"dead_tuples"`
+
+	SeqScans   int64 `json:"seq_scans"`
+	IndexScans int64 `json:"index_scans"`
+
+	LastVacuum      *time.Time `json:"last_vacuum"`
+	LastAutovacuum  *time.Time `json:"last_autovacuum"`
+	LastAnalyze     *time.Time `json:"last_analyze"`
+	LastAutoanalyze *time.Time `json:"last_autoanalyze"`
+
+	Indexes []IndexStats `json:"indexes"`
+}
+
+const tableStatsSQL = `
+SELECT (CASE WHEN s.schemaname = 'public' THEN s.relname ELSE s.schemaname || '.' || s.relname END)::text, c.reltuples::bigint,
+	pg_table_size(s.relid), pg_indexes_size(s.relid), pg_total_relation_size(s.relid),
+	s.n_live_tup, s.n_dead_tup, s.seq_scan, COALESCE(s.idx_scan, 0),
+	s.last_vacuum, s.last_autovacuum, s.last_analyze, s.last_autoanalyze
+FROM pg_stat_user_tables s
+JOIN pg_class c ON c.oid = s.relid
+ORDER BY 1
+`
+
+const indexStatsSQL = `
+SELECT (CASE WHEN s.schemaname = 'public' THEN s.relname ELSE s.schemaname || '.' || s.relname END)::text, s.indexrelname::text, pg_relation_size(s.indexrelid), s.idx_scan, s.idx_tup_read, s.idx_tup_fetch
+FROM pg_stat_user_indexes s
+ORDER BY 1, s.indexrelname
+`
+
+// Gets the size and health of every table. Only TableName, SchemaName and Policy of the filter are used
+func GetTableStats(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) ([]*TableStats, error) {
+	schemas := CurrentPolicy().BrowsableSchemas()
+
+	include := func(tableName string) bool {
+		return contains(schemas, SchemaOf(tableName)) &&
+			(opts.TableName == "" || opts.TableName == tableName) &&
+			(opts.SchemaName == "" || opts.SchemaName == SchemaOf(tableName)) &&
+			(opts.Policy == nil || opts.Policy.CanRead(tableName))
+	}
+
+	rows, err := pool.Query(ctx, tableStatsSQL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var stats = []*TableStats{}
+	var byName = make(map[string]*TableStats)
+
+	for rows.Next() {
+		var t = TableStats{Indexes: []IndexStats{}}
+
+		err := rows.Scan(
+			&t.TableName, &t.EstimatedRows,
+			&t.TableSize, &t.IndexSize, &t.TotalSize,
+			&t.LiveTuples, &t.DeadTuples, &t.SeqScans, &t.IndexScans,
+			&t.LastVacuum, &t.LastAutovacuum, &t.LastAnalyze, &t.LastAutoanalyze,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !include(t.TableName) {
+			continue
+		}
+
+		stats = append(stats, &t)
+		byName[t.TableName] = &t
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows.Close()
+
+	rows, err = pool.Query(ctx, indexStatsSQL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var tableName string
+		var index IndexStats
+
+		if err := rows.Scan(&tableName, &index.Name, &index.Size, &index.Scans, &index.TuplesRead, &index.TuplesFetched); err != nil {
+			return nil, err
+		}
+
+		if t, ok := byName[tableName]; ok {
+			t.Indexes = append(t.Indexes, index)
+		}
+	}
+
+	return stats, rows.Err()
+}
@@ -6,15 +6,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
-	"reflect"
+	"regexp"
 	"strings"
 	"time"
 	"unsafe"
 
 	"github.com/alexedwards/argon2id"
 	"github.com/go-redis/redis/v8"
-	"github.com/jackc/pgtype"
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pquerna/otp/totp"
@@ -25,7 +23,10 @@ import (
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 type Schema struct {
+	// Tables outside the public schema are named schema.table
 	TableName  string  `json:"table_name"`
+	SchemaName string  `json:"schema_name"`
+	Kind       string  `json:"kind"`
 	ColumnName string  `json:"column_name"`
 	Type       string  `json:"type"`
 	IsNullable bool    `json:"nullable"`
@@ -33,44 +34,26 @@ type Schema struct {
 	DefaultSQL *string `json:"default_sql"`
 	DefaultVal any     `json:"default_val"`
 	Secret     bool    `json:"secret"`
+	Masked     bool    `json:"masked"`
+
+	// Whether the default is an expression (such as now() or nextval(...)) rather than a constant. These are
+	// never evaluated (nextval would use up a value), so only DefaultSQL is set
+	DefaultVolatile bool `json:"default_volatile"`
+
+	// The postgres enum type or the enum in lynx_enums.json the column uses, if any
+	EnumType string `json:"enum_type,omitempty"`
+
+	// The values the column can hold, with their names
+	Values []EnumValue `json:"values,omitempty"`
+
+	// For views and materialized views, the table columns the view reads (as table.column, or table.* if it
+	// reads whole rows). Postgres does not record which view column comes from which, so these are per view
+	Sources []string `json:"-"`
 }
 
+// Whether a column is secret (never shown to anyone) under the loaded policy
 func IsSecret(tableName, columnName string) bool {
-	colArray := [2]string{tableName, columnName}
-
-	secretCols := [][2]string{
-		{
-			"bots", "api_token",
-		},
-		{
-			"bots", "webhook_secret",
-		},
-		{
-			"users", "api_token",
-		},
-		{
-			"users", "staff_password",
-		},
-		{
-			"users", "totp_shared_key",
-		},
-		{
-			"users", "supabase_id",
-		},
-		{
-			"servers", "api_token",
-		},
-		{
-			"servers", "webhook_secret",
-		},
-	}
-
-	for _, col := range secretCols {
-		if colArray == col {
-			return true
-		}
-	}
-	return false
+	return contains(CurrentPolicy().Secret, tableName+"."+columnName)
 }
 
 type schemaData struct {
@@ -80,92 +63,238 @@ type schemaData struct {
 	DataType      string  `db:"data_type"`
 	ElementType   *string `db:"element_type"`
 	IsNullable    string  `db:"is_nullable"`
+	UdtName       string  `db:"udt_name"`
+	SchemaName    string  `db:"table_schema"`
+	TableType     string  `db:"table_type"`
+	Position      int32   `db:"position"`
 }
 
 // Filter the postgres schema
 type SchemaFilter struct {
 	TableName string
+
+	// Only tables in this postgres schema
+	SchemaName string
+
+	// If set, tables the user cannot read are left out and hidden columns are marked as secret
+	Policy *EffectivePolicy
 }
 
-func GetSchema(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) ([]Schema, error) {
-	var sqlString string = `
-	SELECT c.is_nullable, c.table_name, c.column_name, c.column_default, c.data_type AS data_type, e.data_type AS element_type FROM information_schema.columns c LEFT JOIN information_schema.element_types e
-	ON ((c.table_catalog, c.table_schema, c.table_name, 'TABLE', c.dtd_identifier)
-= (e.object_catalog, e.object_schema, e.object_name, e.object_type, e.collection_type_identifier))
-WHERE table_schema = 'public' order by table_name, ordinal_position
+// Matches defaults that are a constant, optionally cast: 'text'::type, 42, (-1), true, NULL::type
+var constantDefault = regexp.MustCompile(`^\(*(?:'(?:[^']|'')*'|-?[0-9]+(?:\.[0-9]+)?|true|false|NULL)\)*(?:::[a-zA-Z0-9_ ."\[\](),]+)?$`)
+
+// Evaluates the default of a column, in a transaction that is rolled back as defaults can have side effects
+func evalDefault(ctx context.Context, pool *pgxpool.Pool, defaultSQL string) (any, error) {
+	tx, err := pool.Begin(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback(ctx)
+
+	var val any
+
+	err = tx.QueryRow(ctx, "SELECT "+defaultSQL).Scan(&val)
+
+	return val, err
+}
+
+// The table columns each view or materialized view reads, from the dependencies of its rewrite rule. Every table
+// a view reads has a dependency on the whole table, so those only count if the view has a whole row reference
+const viewSourcesSQL = `
+SELECT DISTINCT vn.nspname::text, v.relname::text, sn.nspname::text, s.relname::text, CASE WHEN d.refobjsubid = 0 THEN '*' ELSE a.attname::text END
+FROM pg_depend d
+JOIN pg_rewrite r ON r.oid = d.objid
+JOIN pg_class v ON v.oid = r.ev_class
+JOIN pg_namespace vn ON vn.oid = v.relnamespace
+JOIN pg_class s ON s.oid = d.refobjid
+JOIN pg_namespace sn ON sn.oid = s.relnamespace
+LEFT JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+WHERE d.classid = 'pg_rewrite'::regclass AND d.refclassid = 'pg_class'::regclass
+AND v.relkind IN ('v', 'm') AND d.refobjid <> v.oid
+AND (d.refobjsubid > 0 OR r.ev_action::text LIKE '%:varattno 0 %')
 `
-	rows, err := pool.Query(ctx, sqlString)
+
+// Loads the table columns every view reads, following views of views down to tables
+func loadViewSources(ctx context.Context, pool *pgxpool.Pool) (map[string][]string, error) {
+	rows, err := pool.Query(ctx, viewSourcesSQL)
 
 	if err != nil {
 		return nil, err
 	}
 
-	var result []Schema
+	defer rows.Close()
+
+	var direct = make(map[string][]string)
 
 	for rows.Next() {
-		var schema Schema
+		var viewSchema, viewName, srcSchema, srcName, column string
 
-		data := schemaData{}
+		if err := rows.Scan(&viewSchema, &viewName, &srcSchema, &srcName, &column); err != nil {
+			return nil, err
+		}
 
-		err := rows.Scan(&data.IsNullable, &data.TableName, &data.ColumnName, &data.ColumnDefault, &data.DataType, &data.ElementType)
+		view := QualifiedName(viewSchema, viewName)
 
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+		direct[view] = append(direct[view], QualifiedName(srcSchema, srcName)+"."+column)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var resolve func(view string, depth int) []string
+
+	resolve = func(view string, depth int) []string {
+		var result []string
+
+		for _, src := range direct[view] {
+			table := src[:strings.LastIndex(src, ".")]
+
+			// Any column of a view is treated as all of it, as which view column comes from where is unknown
+			if _, isView := direct[table]; isView && table != view && depth < 16 {
+				result = append(result, resolve(table, depth+1)...)
+			} else {
+				result = append(result, src)
+			}
 		}
 
-		if opts.TableName != "" && opts.TableName != data.TableName {
-			fmt.Println("Ignoring table", data.TableName, "as it is not", opts.TableName)
-			continue
+		return result
+	}
+
+	var sources = make(map[string][]string, len(direct))
+
+	for view := range direct {
+		sources[view] = resolve(view, 0)
+	}
+
+	return sources, nil
+}
+
+// Whether the columns of a view that reads sources may be shown. Views that read a secret column, or (with a
+// policy) a table that cannot be read or a hidden or masked column, are left out rather than guessing which of
+// their columns it ends up in
+func SourcesVisible(sources []string, policy *EffectivePolicy) bool {
+	var current = CurrentPolicy()
+
+	for _, src := range sources {
+		i := strings.LastIndex(src, ".")
+		table, column := src[:i], src[i+1:]
+
+		if policy != nil && !policy.CanRead(table) {
+			return false
 		}
 
-		// Create new transaction to get default column
-		if data.ColumnDefault != nil && *data.ColumnDefault != "" {
-			tx, err := pool.Begin(ctx)
-			if err != nil {
-				return nil, err
-			}
+		// Nothing protects the columns of schemas that cannot be browsed
+		if !contains(current.BrowsableSchemas(), SchemaOf(table)) {
+			return false
+		}
 
-			var defaultV any
+		var restricted = [][]string{current.Secret}
 
-			err = tx.QueryRow(ctx, "SELECT "+*data.ColumnDefault).Scan(&defaultV)
+		if policy != nil {
+			restricted = append(restricted, policy.HiddenColumns, policy.MaskedColumns)
+		}
 
-			if err != nil {
-				return nil, err
+		for _, cols := range restricted {
+			for _, col := range cols {
+				if col == src || (column == "*" && strings.HasPrefix(col, table+".") && !strings.Contains(col[len(table)+1:], ".")) {
+					return false
+				}
 			}
+		}
+	}
 
-			fmt.Println(data.ColumnName, reflect.TypeOf(defaultV))
+	return true
+}
 
-			err = tx.Rollback(ctx)
+// Loads the schema from postgres, only the table or postgres schema in opts if set. GetSchema should be used
+// instead as it is cached. Volatile defaults are not evaluated
+func loadSchema(ctx context.Context, pool *pgxpool.Pool, opts SchemaFilter) ([]Schema, error) {
+	// information_schema.columns has no materialized views, so they are read from pg_catalog in the same shape
+	var sqlString string = `
+	SELECT c.is_nullable, c.table_schema::text, c.table_name, c.column_name, c.column_default, c.data_type AS data_type, e.data_type AS element_type, COALESCE(e.udt_name, c.udt_name)::text AS udt_name, t.table_type::text, c.ordinal_position::int AS position FROM information_schema.columns c LEFT JOIN information_schema.element_types e
+	ON ((c.table_catalog, c.table_schema, c.table_name, 'TABLE', c.dtd_identifier)
+= (e.object_catalog, e.object_schema, e.object_name, e.object_type, e.collection_type_identifier))
+JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+WHERE c.table_schema = ANY($3::text[])
+AND ($1::text = '' OR c.table_schema = $1) AND ($2::text = '' OR c.table_name = $2)
+UNION ALL
+SELECT CASE WHEN a.attnotnull THEN 'NO' ELSE 'YES' END, n.nspname::text, cl.relname::text, a.attname::text, NULL,
+	CASE WHEN ty.typcategory = 'A' THEN 'ARRAY' WHEN ty.typtype = 'e' THEN 'USER-DEFINED' ELSE format_type(a.atttypid, NULL) END,
+	CASE WHEN ty.typcategory = 'A' THEN format_type(ty.typelem, NULL) END,
+	(CASE WHEN ty.typcategory = 'A' THEN et.typname ELSE ty.typname END)::text,
+	'MATERIALIZED VIEW', a.attnum::int
+FROM pg_attribute a
+JOIN pg_class cl ON cl.oid = a.attrelid
+JOIN pg_namespace n ON n.oid = cl.relnamespace
+JOIN pg_type ty ON ty.oid = a.atttypid
+LEFT JOIN pg_type et ON et.oid = ty.typelem
+WHERE cl.relkind = 'm' AND a.attnum > 0 AND NOT a.attisdropped AND ` + userSchemaSQL("n", "$3") + `
+AND ($1::text = '' OR n.nspname = $1) AND ($2::text = '' OR cl.relname = $2)
+ORDER BY 2, 3, 10
+`
+	enums, err := loadEnums(ctx, pool)
 
-			if err != nil {
-				return nil, err
-			}
+	if err != nil {
+		return nil, err
+	}
 
-			// Check for [16]uint8 case
-			if defaultVal, ok := defaultV.([16]uint8); ok {
-				defaultV = fmt.Sprintf("%x-%x-%x-%x-%x", defaultVal[0:4], defaultVal[4:6], defaultVal[6:8], defaultVal[8:10], defaultVal[10:16])
-			}
+	var schemaName, tableName = opts.SchemaName, ""
 
-			schema.DefaultVal = defaultV
-		} else {
-			schema.DefaultVal = nil
+	if opts.TableName != "" {
+		schemaName = SchemaOf(opts.TableName)
+		tableName = strings.TrimPrefix(opts.TableName, schemaName+".")
+	}
+
+	viewSources, err := loadViewSources(ctx, pool)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := pool.Query(ctx, sqlString, schemaName, tableName, CurrentPolicy().BrowsableSchemas())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var result []Schema
+
+	for rows.Next() {
+		var schema Schema
+
+		data := schemaData{}
+
+		err := rows.Scan(&data.IsNullable, &data.SchemaName, &data.TableName, &data.ColumnName, &data.ColumnDefault, &data.DataType, &data.ElementType, &data.UdtName, &data.TableType, &data.Position)
+
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
 		}
 
-		// Now check if the column is tagged properly
-		var tag pgtype.UUID
-		if err := pool.QueryRow(ctx, "SELECT _lynxtag FROM"+data.TableName).Scan(&tag); err != nil {
-			if err == pgx.ErrNoRows {
-				fmt.Println("Tagging", data.TableName)
-				_, err := pool.Exec(ctx, "ALTER TABLE "+data.TableName+" ADD COLUMN _lynxtag uuid not null unique default uuid_generate_v4()")
+		// Only constant defaults are evaluated, volatile ones are left as DefaultSQL
+		var defaultData any
+
+		if data.ColumnDefault != nil && *data.ColumnDefault != "" {
+			if constantDefault.MatchString(*data.ColumnDefault) {
+				defaultData, err = evalDefault(ctx, pool, *data.ColumnDefault)
+
 				if err != nil {
 					return nil, err
 				}
+			} else {
+				schema.DefaultVolatile = true
 			}
 		}
 
 		schema.ColumnName = data.ColumnName
-		schema.TableName = data.TableName
+		schema.TableName = QualifiedName(data.SchemaName, data.TableName)
+		schema.SchemaName = data.SchemaName
+		schema.Kind = tableKinds[data.TableType]
 		schema.DefaultSQL = data.ColumnDefault
 
 		schema.IsNullable = (data.IsNullable == "YES")
@@ -177,7 +306,21 @@ WHERE table_schema = 'public' order by table_name, ordinal_position
 			schema.Type = data.DataType
 		}
 
-		schema.Secret = IsSecret(data.TableName, data.ColumnName)
+		// Postgres enums are USER-DEFINED columns whose type has labels in pg_enum
+		if labels, ok := enums[data.UdtName]; ok {
+			schema.EnumType = data.UdtName
+			schema.Values = labels
+		}
+
+		schema.Secret = IsSecret(schema.TableName, data.ColumnName)
+		schema.Sources = viewSources[schema.TableName]
+
+		// Default values are encoded like any other value of the column
+		schema.DefaultVal, err = EncodeValue(&schema, defaultData)
+
+		if err != nil {
+			return nil, err
+		}
 
 		result = append(result, schema)
 	}
@@ -229,11 +372,6 @@ func GetPermissions(devMode bool, userID string) (*UserPerms, error) {
 	return &perms, nil
 }
 
-type sessionStruct struct {
-	ID    string `json:"user_id"`
-	Token string `json:"token"`
-}
-
 type AuthRequest struct {
 	// The users ID
 	UserID string
@@ -247,9 +385,12 @@ type AuthRequest struct {
 	// User Password
 	Password string
 
-	// 2FA code
+	// 2FA code, or a recovery code
 	TOTP string
 
+	// WebAuthn assertion (JSON), satisfies MFA in place of TOTP
+	WebAuthn string
+
 	// Developer mode or not
 	DevMode bool
 
@@ -263,7 +404,7 @@ type AuthRequest struct {
 	Redis *redis.Client
 }
 
-type authResponse struct {
+type AuthResponse struct {
 	// The users permissions
 	Perms UserPerms
 
@@ -273,18 +414,34 @@ type authResponse struct {
 	// If the user is MFA key verified or not
 	MFA bool
 
+	// If a recovery code was sent in place of a TOTP code. It has not been checked yet as that uses it up,
+	// routes that need MFA check it with UseRecoveryCode once everything else has passed. MFA is false for it
+	RecoveryCode bool
+
+	// If MFA was satisfied with a WebAuthn assertion, which cannot be used again
+	WebAuthn bool
+
 	// If the user has logged in with a password successfully
 	PasswordLogin bool
 
-	// The allowed tables of the user, empty slice if all are allowed
+	// The tables the user may read, ["*"] if every table is allowed and empty if none are
 	AllowedTables []string
 
+	// The access policy that applies to the user
+	Policy *EffectivePolicy
+
 	// Whether or not the users session was validated or not
 	SessionValidated bool
+
+	// The validated session, if any
+	Session *Session
+
+	// How long until the validated session expires unless it is used again, zero without one
+	SessionExpiresIn time.Duration
 }
 
 // Helper function to authenticate a user
-func AuthorizeUser(req AuthRequest) (*authResponse, error) {
+func AuthorizeUser(req AuthRequest) (*AuthResponse, error) {
 	if req.Token == "" {
 		return nil, errors.New("no token provided")
 	}
@@ -341,7 +498,24 @@ func AuthorizeUser(req AuthRequest) (*authResponse, error) {
 		mfa = true
 	}
 
-	fmt.Println(totpKey, req.TOTP, mfa)
+	// A security key or passkey can also be used in place of a TOTP code
+	var webAuthn bool
+
+	if !mfa && req.WebAuthn != "" {
+		err = VerifyWebAuthnAssertion(req.Context, req.DB, req.Redis, req.DevMode, req.UserID, req.WebAuthn)
+
+		if errors.Is(err, ErrInvalidWebAuthn) {
+			fmt.Println(err)
+		} else if err != nil {
+			return nil, err
+		} else {
+			webAuthn = true
+			mfa = true
+		}
+	}
+
+	// A recovery code can be sent in place of a TOTP code, it is only checked (and used up) by routes that need MFA
+	var recoveryCode = !mfa && IsRecoveryCode(req.TOTP)
 
 	// Check password
 	var passAuth bool
@@ -363,46 +537,58 @@ func AuthorizeUser(req AuthRequest) (*authResponse, error) {
 	// SessionValidated is true if the session was validated
 	var sessionValidated bool
 
+	var session *Session
+
 	if req.SessionID != "" {
-		// Check session in redis
-		var session = req.Redis.Get(req.Context, req.SessionID).Val()
+		session, err = GetSession(req.Context, req.Redis, req.SessionID)
 
-		if session != "" {
-			// JSON parse it (or try to)
-			var sessionData sessionStruct
+		if err != nil {
+			return nil, err
+		}
 
-			err := json.Unmarshal([]byte(session), &sessionData)
+		if session != nil {
+			// The session must belong to this user and the token it was created with
+			if session.UserID != req.UserID || session.Token != req.Token {
+				return nil, errors.New("invalid session")
+			}
 
-			if err != nil {
-				fmt.Println(err)
+			// A session that has just expired is treated like one that is gone
+			if err := TouchSession(req.Context, req.Redis, session); err == ErrSessionExpired {
+				session = nil
+			} else if err != nil {
+				return nil, err
 			} else {
-				if sessionData.ID != req.UserID {
-					return nil, errors.New("invalid session")
-				} else {
-					// Check token with the token that was in auth request (that was also validated)
-					if sessionData.Token != req.Token {
-						return nil, errors.New("invalid session")
-					}
-					sessionValidated = true
-				}
+				sessionValidated = true
 			}
 		}
 	}
 
-	allowedTokens := []string{}
+	var sessionExpiresIn time.Duration
+
+	if session != nil {
+		sessionExpiresIn = time.Until(session.ExpiresAt)
+	}
+
+	userPolicy := CurrentPolicy().ForPerm(perms.Perm)
+
+	allowedTables := userPolicy.ReadableTables
 
-	if perms.Perm < 5 {
-		allowedTokens = []string{"reviews", "review_votes", "bot_packs", "vanity", "leave_of_absence", "user_vote_table",
-			"lynx_surveys", "lynx_survey_responses"}
+	if userPolicy.ReadAll {
+		allowedTables = []string{"*"}
 	}
 
-	resp := &authResponse{
+	resp := &AuthResponse{
 		Perms:            *perms,
 		Verified:         verified,
 		MFA:              mfa,
-		AllowedTables:    allowedTokens,
+		RecoveryCode:     recoveryCode,
+		WebAuthn:         webAuthn,
+		AllowedTables:    allowedTables,
+		Policy:           userPolicy,
 		PasswordLogin:    passAuth,
 		SessionValidated: sessionValidated,
+		Session:          session,
+		SessionExpiresIn: sessionExpiresIn,
 	}
 
 	return resp, nil
@@ -414,7 +600,8 @@ func CorsWrap(fn HFunc) HFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Frostpaw-ID, Frostpaw-MFA, Authorization, Frostpaw-Pass")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Frostpaw-ID, Frostpaw-MFA, Frostpaw-WebAuthn, Authorization, Frostpaw-Pass")
+		w.Header().Set("Access-Control-Expose-Headers", "Frostpaw-Cursor, Frostpaw-Session-Expires, Retry-After")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		if r.Method == "OPTIONS" {
 			w.Write([]byte(""))
@@ -0,0 +1,621 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The table registered security keys and passkeys are stored in
+const WebAuthnTable = "lynx_webauthn_credentials"
+
+// Returned (wrapped) when a WebAuthn response does not check out
+var ErrInvalidWebAuthn = errors.New("invalid webauthn response")
+
+// COSE algorithm identifiers of the supported key types
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+const webAuthnTimeout = 5 * time.Minute
+
+// The relying party ID and the origin the panel is served from
+func webAuthnRP(devMode bool) (rpID string, origin string) {
+	if devMode {
+		return "localhost", ""
+	}
+
+	return "fateslist.xyz", "https://lynx.fateslist.xyz"
+}
+
+func checkOrigin(devMode bool, origin string) bool {
+	rpID, want := webAuthnRP(devMode)
+
+	if want != "" {
+		return origin == want
+	}
+
+	u, err := url.Parse(origin)
+
+	return err == nil && u.Hostname() == rpID
+}
+
+// A registered security key or passkey
+type WebAuthnCredential struct {
+	// The base64url credential ID
+	ID string `json:"id"`
+
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used"`
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type webAuthnParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webAuthnRPEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type webAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+// PublicKeyCredentialCreationOptions for navigator.credentials.create, binary fields are base64url
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     webAuthnRPEntity               `json:"rp"`
+	User                   webAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []webAuthnParam                `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []webAuthnCredentialDescriptor `json:"excludeCredentials"`
+	Attestation            string                         `json:"attestation"`
+	AuthenticatorSelection map[string]string              `json:"authenticatorSelection"`
+}
+
+// PublicKeyCredentialRequestOptions for navigator.credentials.get, binary fields are base64url
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	Timeout          int64                          `json:"timeout"`
+	AllowCredentials []webAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+// The PublicKeyCredential returned by navigator.credentials.create or get, binary fields are base64url
+type WebAuthnResponse struct {
+	ID       string `json:"id"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decodes base64url, with or without padding
+func unb64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func webAuthnChallengeKey(userID, kind string) string {
+	return "lynx_webauthn_challenge:" + kind + ":" + userID
+}
+
+// Creates a challenge for a user, replacing any earlier one of the same kind
+func newWebAuthnChallenge(ctx context.Context, rdb *redis.Client, userID, kind string) (string, error) {
+	var b = make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	challenge := b64(b)
+
+	return challenge, rdb.Set(ctx, webAuthnChallengeKey(userID, kind), challenge, webAuthnTimeout).Err()
+}
+
+func credentialDescriptors(ctx context.Context, pool *pgxpool.Pool, userID string) ([]webAuthnCredentialDescriptor, error) {
+	creds, err := ListWebAuthnCredentials(ctx, pool, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var descs = []webAuthnCredentialDescriptor{}
+
+	for _, c := range creds {
+		descs = append(descs, webAuthnCredentialDescriptor{Type: "public-key", ID: c.ID})
+	}
+
+	return descs, nil
+}
+
+// Starts registering a security key or passkey
+func WebAuthnRegistrationOptions(ctx context.Context, pool *pgxpool.Pool, rdb *redis.Client, devMode bool, userID string) (*WebAuthnCreationOptions, error) {
+	challenge, err := newWebAuthnChallenge(ctx, rdb, userID, "create")
+
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := credentialDescriptors(ctx, pool, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rpID, _ := webAuthnRP(devMode)
+
+	return &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        webAuthnRPEntity{ID: rpID, Name: "Fates List Lynx"},
+		User:      webAuthnUserEntity{ID: b64([]byte(userID)), Name: userID, DisplayName: userID},
+		PubKeyCredParams: []webAuthnParam{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:                webAuthnTimeout.Milliseconds(),
+		ExcludeCredentials:     exclude,
+		Attestation:            "none",
+		AuthenticatorSelection: map[string]string{"userVerification": "discouraged"},
+	}, nil
+}
+
+// Starts a WebAuthn login, returns ErrInvalidWebAuthn if the user has no registered credentials
+func WebAuthnAssertionOptions(ctx context.Context, pool *pgxpool.Pool, rdb *redis.Client, devMode bool, userID string) (*WebAuthnRequestOptions, error) {
+	allow, err := credentialDescriptors(ctx, pool, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(allow) == 0 {
+		return nil, fmt.Errorf("%w: no security keys are registered", ErrInvalidWebAuthn)
+	}
+
+	challenge, err := newWebAuthnChallenge(ctx, rdb, userID, "get")
+
+	if err != nil {
+		return nil, err
+	}
+
+	rpID, _ := webAuthnRP(devMode)
+
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		RPID:             rpID,
+		Timeout:          webAuthnTimeout.Milliseconds(),
+		AllowCredentials: allow,
+		UserVerification: "discouraged",
+	}, nil
+}
+
+// Uses up the pending challenge of a kind for a user, returning an empty string if there is none
+func takeWebAuthnChallenge(ctx context.Context, rdb *redis.Client, userID, kind string) (string, error) {
+	challenge, err := rdb.GetDel(ctx, webAuthnChallengeKey(userID, kind)).Result()
+
+	if err == redis.Nil {
+		return "", nil
+	}
+
+	return challenge, err
+}
+
+// Checks the client data of a response answers challenge, which must already have been used up
+func checkClientData(devMode bool, kind, challenge string, raw []byte) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	if challenge == "" {
+		return fmt.Errorf("%w: no challenge is pending or it has expired", ErrInvalidWebAuthn)
+	}
+
+	if clientData.Type != "webauthn."+kind || clientData.Challenge != challenge {
+		return fmt.Errorf("%w: wrong type or challenge", ErrInvalidWebAuthn)
+	}
+
+	if !checkOrigin(devMode, clientData.Origin) {
+		return fmt.Errorf("%w: wrong origin %s", ErrInvalidWebAuthn, clientData.Origin)
+	}
+
+	return nil
+}
+
+type authenticatorData struct {
+	flags     byte
+	signCount uint32
+
+	// Only set during registration
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(devMode bool, data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidWebAuthn)
+	}
+
+	rpID, _ := webAuthnRP(devMode)
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: wrong relying party", ErrInvalidWebAuthn)
+	}
+
+	ad := &authenticatorData{flags: data[32], signCount: binary.BigEndian.Uint32(data[33:37])}
+
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidWebAuthn)
+	}
+
+	if ad.flags&flagAttestedData != 0 {
+		// AAGUID, then the length of the credential ID
+		rest := data[37:]
+
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidWebAuthn)
+		}
+
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+
+		if len(rest) < idLen {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidWebAuthn)
+		}
+
+		ad.credentialID = rest[:idLen]
+
+		_, n, err := decodeCBOR(rest[idLen:])
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %s", ErrInvalidWebAuthn, err)
+		}
+
+		ad.publicKey = rest[idLen : idLen+n]
+	}
+
+	return ad, nil
+}
+
+// Parses a COSE public key into a key verifySignature can use
+func parseCOSEKey(raw []byte) (any, error) {
+	v, _, err := decodeCBOR(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := v.(map[any]any)
+
+	if !ok {
+		return nil, errCBOR
+	}
+
+	alg, _ := m[int64(3)].(int64)
+
+	switch alg {
+	case coseES256:
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+
+		if crv, _ := m[int64(-1)].(int64); crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported ec2 key")
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec2 key is not on the curve")
+		}
+
+		return key, nil
+	case coseEdDSA:
+		x, _ := m[int64(-2)].([]byte)
+
+		if crv, _ := m[int64(-1)].(int64); crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported okp key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	case coseRS256:
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported rsa key")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+func verifySignature(key any, data, sig []byte) bool {
+	hash := sha256.Sum256(data)
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	}
+
+	return false
+}
+
+// Checks a registration response answers challenge, returning the authenticator data with the new credential
+func verifyRegistration(devMode bool, challenge string, resp WebAuthnResponse) (*authenticatorData, error) {
+	clientData, err := unb64(resp.Response.ClientDataJSON)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	if err := checkClientData(devMode, "create", challenge, clientData); err != nil {
+		return nil, err
+	}
+
+	attestation, err := unb64(resp.Response.AttestationObject)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	obj, _, err := decodeCBOR(attestation)
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %s", ErrInvalidWebAuthn, err)
+	}
+
+	m, _ := obj.(map[any]any)
+	rawAuthData, _ := m["authData"].([]byte)
+
+	ad, err := parseAuthenticatorData(devMode, rawAuthData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ad.publicKey == nil || b64(ad.credentialID) != resp.ID {
+		return nil, fmt.Errorf("%w: missing or mismatched credential", ErrInvalidWebAuthn)
+	}
+
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	return ad, nil
+}
+
+// Finishes registering a security key or passkey. The attestation statement is not checked as
+// "none" attestation is requested, any authenticator the staff member owns is accepted
+func RegisterWebAuthnCredential(ctx context.Context, pool *pgxpool.Pool, rdb *redis.Client, devMode bool, userID, name string, resp WebAuthnResponse) (*WebAuthnCredential, error) {
+	challenge, err := takeWebAuthnChallenge(ctx, rdb, userID, "create")
+
+	if err != nil {
+		return nil, err
+	}
+
+	ad, err := verifyRegistration(devMode, challenge, resp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &WebAuthnCredential{ID: resp.ID, Name: name}
+
+	err = pool.QueryRow(
+		ctx,
+		"INSERT INTO "+WebAuthnTable+" (id, user_id, name, public_key, sign_count) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING RETURNING created_at",
+		cred.ID,
+		userID,
+		name,
+		ad.publicKey,
+		int64(ad.signCount),
+	).Scan(&cred.CreatedAt)
+
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("%w: this credential is already registered", ErrInvalidWebAuthn)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+// Checks an assertion answers challenge and is signed by the credential with the COSE key rawKey, which
+// last signed with signCount. Returns the new signature counter
+func verifyAssertion(devMode bool, challenge string, resp WebAuthnResponse, rawKey []byte, signCount int64) (uint32, error) {
+	clientData, err := unb64(resp.Response.ClientDataJSON)
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	if err := checkClientData(devMode, "get", challenge, clientData); err != nil {
+		return 0, err
+	}
+
+	rawAuthData, err := unb64(resp.Response.AuthenticatorData)
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	sig, err := unb64(resp.Response.Signature)
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	ad, err := parseAuthenticatorData(devMode, rawAuthData)
+
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parseCOSEKey(rawKey)
+
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientData)
+
+	if !verifySignature(key, append(rawAuthData[:len(rawAuthData):len(rawAuthData)], clientDataHash[:]...), sig) {
+		return 0, fmt.Errorf("%w: bad signature", ErrInvalidWebAuthn)
+	}
+
+	if !signCountValid(signCount, ad.signCount) {
+		return 0, errSignCount
+	}
+
+	return ad.signCount, nil
+}
+
+var errSignCount = fmt.Errorf("%w: signature counter went backwards", ErrInvalidWebAuthn)
+
+// A counter that does not go up means the authenticator may have been cloned, authenticators
+// without a counter always send zero
+func signCountValid(stored int64, got uint32) bool {
+	return (got == 0 && stored == 0) || int64(got) > stored
+}
+
+// Checks a WebAuthn assertion (the JSON of a WebAuthnResponse) of a user, using up its challenge.
+// Returns an error wrapping ErrInvalidWebAuthn if the assertion is not valid
+func VerifyWebAuthnAssertion(ctx context.Context, pool *pgxpool.Pool, rdb *redis.Client, devMode bool, userID, assertion string) error {
+	var resp WebAuthnResponse
+
+	if err := json.Unmarshal([]byte(assertion), &resp); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidWebAuthn, err)
+	}
+
+	challenge, err := takeWebAuthnChallenge(ctx, rdb, userID, "get")
+
+	if err != nil {
+		return err
+	}
+
+	var rawKey []byte
+	var signCount int64
+
+	err = pool.QueryRow(ctx, "SELECT public_key, sign_count FROM "+WebAuthnTable+" WHERE id = $1 AND user_id = $2", resp.ID, userID).Scan(&rawKey, &signCount)
+
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("%w: unknown credential", ErrInvalidWebAuthn)
+	} else if err != nil {
+		return err
+	}
+
+	newCount, err := verifyAssertion(devMode, challenge, resp, rawKey, signCount)
+
+	if err != nil {
+		return err
+	}
+
+	// Checked again in the update, as two assertions from a cloned authenticator could have raced
+	tag, err := pool.Exec(
+		ctx,
+		"UPDATE "+WebAuthnTable+" SET sign_count = $1, last_used = NOW() WHERE id = $2 AND (sign_count < $1 OR ($1 = 0 AND sign_count = 0))",
+		int64(newCount),
+		resp.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return errSignCount
+	}
+
+	return nil
+}
+
+// Lists the registered credentials of a user, oldest first
+func ListWebAuthnCredentials(ctx context.Context, pool *pgxpool.Pool, userID string) ([]WebAuthnCredential, error) {
+	rows, err := pool.Query(ctx, "SELECT id, name, created_at, last_used FROM "+WebAuthnTable+" WHERE user_id = $1 ORDER BY created_at", userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var creds = []WebAuthnCredential{}
+
+	for rows.Next() {
+		var c WebAuthnCredential
+
+		if err := rows.Scan(&c.ID, &c.Name, &c.CreatedAt, &c.LastUsed); err != nil {
+			return nil, err
+		}
+
+		creds = append(creds, c)
+	}
+
+	return creds, rows.Err()
+}
+
+// Removes a registered credential of a user, returns false if it did not exist
+func DeleteWebAuthnCredential(ctx context.Context, pool *pgxpool.Pool, userID, id string) (bool, error) {
+	tag, err := pool.Exec(ctx, "DELETE FROM "+WebAuthnTable+" WHERE id = $1 AND user_id = $2", id, userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
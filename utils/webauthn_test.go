@@ -0,0 +1,459 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"testing"
+)
+
+// Encodes the subset of CBOR decodeCBOR supports, map keys are sorted so the output is stable
+func encodeCBOR(v any) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg <= 0xff:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg <= 0xffff:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(arg))
+			return b
+		default:
+			b := []byte{major<<5 | 26, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(b[1:], uint32(arg))
+			return b
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		var entries [][]byte
+
+		for k, val := range v {
+			entries = append(entries, append(encodeCBOR(k), encodeCBOR(val)...))
+		}
+
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i]) < string(entries[j]) })
+
+		out := head(5, uint64(len(v)))
+
+		for _, entry := range entries {
+			out = append(out, entry...)
+		}
+
+		return out
+	}
+
+	panic("unsupported cbor value")
+}
+
+// A software authenticator holding one credential
+type softAuthenticator struct {
+	rpID   string
+	id     []byte
+	es256  *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	count  uint32
+	frozen bool
+}
+
+func newSoftAuthenticator(t *testing.T, alg int, rpID string) *softAuthenticator {
+	a := &softAuthenticator{rpID: rpID, id: make([]byte, 16)}
+
+	rand.Read(a.id)
+
+	var err error
+
+	switch alg {
+	case coseES256:
+		a.es256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case coseEdDSA:
+		_, a.ed, err = ed25519.GenerateKey(rand.Reader)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.es256 != nil {
+		return encodeCBOR(map[any]any{
+			1:  2,
+			3:  coseES256,
+			-1: 1,
+			-2: a.es256.X.FillBytes(make([]byte, 32)),
+			-3: a.es256.Y.FillBytes(make([]byte, 32)),
+		})
+	}
+
+	return encodeCBOR(map[any]any{
+		1:  1,
+		3:  coseEdDSA,
+		-1: 6,
+		-2: []byte(a.ed.Public().(ed25519.PublicKey)),
+	})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+
+	var flags byte = flagUserPresent
+
+	if attested {
+		flags |= flagAttestedData
+	}
+
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.count)
+
+	if attested {
+		data = append(data, make([]byte, 18)...)
+		binary.BigEndian.PutUint16(data[len(data)-2:], uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func clientDataJSON(kind, challenge, origin string) []byte {
+	b, _ := json.Marshal(map[string]string{"type": "webauthn." + kind, "challenge": challenge, "origin": origin})
+	return b
+}
+
+func (a *softAuthenticator) create(challenge, origin string) WebAuthnResponse {
+	var resp WebAuthnResponse
+
+	resp.ID = b64(a.id)
+	resp.Response.ClientDataJSON = b64(clientDataJSON("create", challenge, origin))
+	resp.Response.AttestationObject = b64(encodeCBOR(map[any]any{
+		"fmt":      "none",
+		"attStmt":  map[any]any{},
+		"authData": a.authData(true),
+	}))
+
+	return resp
+}
+
+func (a *softAuthenticator) get(t *testing.T, challenge, origin string) WebAuthnResponse {
+	if !a.frozen {
+		a.count++
+	}
+
+	clientData := clientDataJSON("get", challenge, origin)
+	clientDataHash := sha256.Sum256(clientData)
+	authData := a.authData(false)
+	signed := append(authData[:len(authData):len(authData)], clientDataHash[:]...)
+
+	var sig []byte
+
+	if a.es256 != nil {
+		hash := sha256.Sum256(signed)
+
+		var err error
+
+		if sig, err = ecdsa.SignASN1(rand.Reader, a.es256, hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		sig = ed25519.Sign(a.ed, signed)
+	}
+
+	var resp WebAuthnResponse
+
+	resp.ID = b64(a.id)
+	resp.Response.ClientDataJSON = b64(clientData)
+	resp.Response.AuthenticatorData = b64(authData)
+	resp.Response.Signature = b64(sig)
+
+	return resp
+}
+
+// Hands out challenges and uses them up like redis does with GetDel
+type challengeStore map[string]string
+
+func (c challengeStore) issue(kind string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	c[kind] = b64(b)
+	return c[kind]
+}
+
+func (c challengeStore) take(kind string) string {
+	challenge := c[kind]
+	delete(c, kind)
+	return challenge
+}
+
+func TestWebAuthn(t *testing.T) {
+	const origin = "https://lynx.fateslist.xyz"
+
+	rpID, _ := webAuthnRP(false)
+
+	tests := []struct {
+		name string
+
+		// Returns the stored sign count, an assertion by the registered authenticator and the challenge taken for it
+		run func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string)
+
+		assertErr bool
+	}{
+		{
+			name: "valid",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				return 0, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+		},
+		{
+			name: "counter at zero for counterless authenticators",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				a.frozen = true
+				return 0, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+		},
+		{
+			name: "wrong origin",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				return 0, a.get(t, store.issue("get"), "https://lynx.fateslist.xyz.evil.example"), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "wrong rp id",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				a.rpID = "evil.example"
+				return 0, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "replayed challenge",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				challenge := store.issue("get")
+				resp := a.get(t, challenge, origin)
+
+				if _, err := verifyAssertion(false, store.take("get"), resp, a.coseKey(), 0); err != nil {
+					t.Fatalf("first use of the challenge failed: %s", err)
+				}
+
+				return 1, a.get(t, challenge, origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "challenge of an earlier request",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				old := store.issue("get")
+				store.issue("get")
+				return 0, a.get(t, old, origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "registration challenge used for assertion",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				return 0, a.get(t, store.issue("create"), origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "counter regression",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				return 5, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "counter not increasing",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				return 1, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "counter dropping to zero",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				a.frozen = true
+				return 3, a.get(t, store.issue("get"), origin), store.take("get")
+			},
+			assertErr: true,
+		},
+		{
+			name: "bad signature",
+			run: func(t *testing.T, a *softAuthenticator, store challengeStore) (int64, WebAuthnResponse, string) {
+				resp := a.get(t, store.issue("get"), origin)
+				sig, _ := unb64(resp.Response.Signature)
+				sig[len(sig)-1] ^= 1
+				resp.Response.Signature = b64(sig)
+				return 0, resp, store.take("get")
+			},
+			assertErr: true,
+		},
+	}
+
+	algs := []struct {
+		name string
+		alg  int
+	}{{"ES256", coseES256}, {"Ed25519", coseEdDSA}}
+
+	for _, alg := range algs {
+		for _, tt := range tests {
+			t.Run(alg.name+"/"+tt.name, func(t *testing.T) {
+				a := newSoftAuthenticator(t, alg.alg, rpID)
+				store := challengeStore{}
+
+				resp := a.create(store.issue("create"), origin)
+
+				ad, err := verifyRegistration(false, store.take("create"), resp)
+
+				if err != nil {
+					t.Fatalf("registration failed: %s", err)
+				}
+
+				signCount, resp, challenge := tt.run(t, a, store)
+
+				_, err = verifyAssertion(false, challenge, resp, ad.publicKey, signCount)
+
+				if tt.assertErr {
+					if !errors.Is(err, ErrInvalidWebAuthn) {
+						t.Fatalf("expected an invalid assertion, got %v", err)
+					}
+				} else if err != nil {
+					t.Fatalf("assertion failed: %s", err)
+				}
+			})
+		}
+	}
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	const origin = "https://lynx.fateslist.xyz"
+
+	rpID, _ := webAuthnRP(false)
+
+	tests := []struct {
+		name string
+		edit func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string)
+		err  bool
+	}{
+		{
+			name: "valid",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				return a.create(store.issue("create"), origin), store.take("create")
+			},
+		},
+		{
+			name: "wrong origin",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				return a.create(store.issue("create"), "https://evil.example"), store.take("create")
+			},
+			err: true,
+		},
+		{
+			name: "wrong rp id",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				a.rpID = "evil.example"
+				return a.create(store.issue("create"), origin), store.take("create")
+			},
+			err: true,
+		},
+		{
+			name: "replayed challenge",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				challenge := store.issue("create")
+				store.take("create")
+				return a.create(challenge, origin), store.take("create")
+			},
+			err: true,
+		},
+		{
+			name: "assertion challenge used for registration",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				return a.create(store.issue("get"), origin), store.take("create")
+			},
+			err: true,
+		},
+		{
+			name: "mismatched credential id",
+			edit: func(a *softAuthenticator, store challengeStore) (WebAuthnResponse, string) {
+				resp := a.create(store.issue("create"), origin)
+				resp.ID = b64([]byte("another credential"))
+				return resp, store.take("create")
+			},
+			err: true,
+		},
+	}
+
+	algs := []struct {
+		name string
+		alg  int
+	}{{"ES256", coseES256}, {"Ed25519", coseEdDSA}}
+
+	for _, alg := range algs {
+		for _, tt := range tests {
+			t.Run(alg.name+"/"+tt.name, func(t *testing.T) {
+				a := newSoftAuthenticator(t, alg.alg, rpID)
+
+				resp, challenge := tt.edit(a, challengeStore{})
+
+				ad, err := verifyRegistration(false, challenge, resp)
+
+				if tt.err {
+					if !errors.Is(err, ErrInvalidWebAuthn) {
+						t.Fatalf("expected an invalid registration, got %v", err)
+					}
+
+					return
+				}
+
+				if err != nil {
+					t.Fatalf("registration failed: %s", err)
+				}
+
+				if _, err := parseCOSEKey(ad.publicKey); err != nil {
+					t.Fatalf("stored key does not parse: %s", err)
+				}
+			})
+		}
+	}
+}
+
+func TestSignCountValid(t *testing.T) {
+	tests := []struct {
+		stored int64
+		got    uint32
+		want   bool
+	}{
+		{0, 0, true},
+		{0, 1, true},
+		{4, 5, true},
+		{5, 5, false},
+		{5, 4, false},
+		{5, 0, false},
+	}
+
+	for _, tt := range tests {
+		if got := signCountValid(tt.stored, tt.got); got != tt.want {
+			t.Errorf("signCountValid(%d, %d) = %v, want %v", tt.stored, tt.got, got, tt.want)
+		}
+	}
+}